@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// controlTimeout is the time the gz commands have to control the world
+const controlTimeout = 10 * time.Second
+
+// defaultStepSize is the physics step size of Gazebo in seconds, used when
+// the world file does not set max_step_size
+const defaultStepSize = 0.001
+
+var errNotPaused = errors.New("simulation not paused")
+
+// worldStats are the statistics published by the world. The times are in
+// seconds.
+type worldStats struct {
+	Paused     bool
+	SimTime    float64
+	RealTime   float64
+	Iterations int64
+	// RealTimeFactor is the sim time per real time since the previous
+	// statistics
+	RealTimeFactor float64
+}
+
+var (
+	simTimePattern    = regexp.MustCompile(`\bsim_time \{([^}]*)\}`)
+	realTimePattern   = regexp.MustCompile(`\breal_time \{([^}]*)\}`)
+	pausedPattern     = regexp.MustCompile(`\bpaused: (true|false)`)
+	iterationsPattern = regexp.MustCompile(`\biterations: (\d+)`)
+	secPattern        = regexp.MustCompile(`\bsec: (-?\d+)`)
+	nsecPattern       = regexp.MustCompile(`\bnsec: (-?\d+)`)
+)
+
+// parseWorldStats parses a gazebo.msgs.WorldStatistics message echoed by
+// gz topic -u
+func parseWorldStats(line string) (worldStats, bool) {
+	simTime, ok := parseMsgTime(simTimePattern, line)
+	if !ok {
+		return worldStats{}, false
+	}
+	realTime, _ := parseMsgTime(realTimePattern, line)
+	stats := worldStats{
+		SimTime:  simTime,
+		RealTime: realTime,
+	}
+	if m := pausedPattern.FindStringSubmatch(line); m != nil {
+		stats.Paused = m[1] == "true"
+	}
+	if m := iterationsPattern.FindStringSubmatch(line); m != nil {
+		stats.Iterations, _ = strconv.ParseInt(m[1], 10, 64)
+	}
+	return stats, true
+}
+
+// parseMsgTime parses the gazebo.msgs.Time field matched by pattern
+func parseMsgTime(pattern *regexp.Regexp, line string) (float64, bool) {
+	m := pattern.FindStringSubmatch(line)
+	if m == nil {
+		return 0, false
+	}
+	var t float64
+	if sec := secPattern.FindStringSubmatch(m[1]); sec != nil {
+		s, _ := strconv.ParseInt(sec[1], 10, 64)
+		t += float64(s)
+	}
+	if nsec := nsecPattern.FindStringSubmatch(m[1]); nsec != nil {
+		ns, _ := strconv.ParseInt(nsec[1], 10, 64)
+		t += float64(ns) / 1e9
+	}
+	return t, true
+}
+
+// simulationStatus is the state of the gzserver process and, while it is
+// running, of its world
+type simulationStatus struct {
+	processStatus
+	World                string   `json:"world,omitempty"`
+	Paused               *bool    `json:"paused,omitempty"`
+	SimTime              *float64 `json:"sim_time,omitempty"`
+	Iterations           *int64   `json:"iterations,omitempty"`
+	RealTimeFactor       *float64 `json:"real_time_factor,omitempty"`
+	TargetRealTimeFactor *float64 `json:"target_real_time_factor,omitempty"`
+}
+
+// ready is called by the supervisor when the world has been loaded
+func (s *Simulation) ready(world string, done <-chan struct{}) {
+	s.lock.Lock()
+	s.world = world
+	s.stats = nil
+	s.poses = make(map[string]dronePose)
+	s.statsDone = done
+	s.lock.Unlock()
+
+	go s.followTopic(fmt.Sprintf("/gazebo/%s/world_stats", world), done, s.statsHandler(done))
+	go s.followTopic(fmt.Sprintf("/gazebo/%s/pose/info", world), done, s.poseHandler(done))
+}
+
+// followTopic calls handle with the messages of the Gazebo topic until the
+// gzserver process exits
+func (s *Simulation) followTopic(topic string, done <-chan struct{}, handle func(line string)) {
+	proc, err := s.runner.Follow(topic+": ", handle, "gz", "topic", "-u", "-e", topic)
+	if err != nil {
+		log.Printf("Could not follow %s: %v", topic, err)
+		return
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-exited:
+		}
+		proc.Kill()
+	}()
+	_, err = proc.Wait()
+	close(exited)
+	select {
+	case <-done:
+	default:
+		log.Printf("Following %s ended: %v", topic, err)
+	}
+}
+
+// statsHandler keeps the world statistics of the process
+func (s *Simulation) statsHandler(done <-chan struct{}) func(line string) {
+	var last *worldStats
+	return func(line string) {
+		stats, ok := parseWorldStats(line)
+		if !ok {
+			return
+		}
+		// the times go back when the world is reset
+		if last != nil && stats.RealTime > last.RealTime && stats.SimTime >= last.SimTime {
+			stats.RealTimeFactor = (stats.SimTime - last.SimTime) / (stats.RealTime - last.RealTime)
+		}
+		last = &stats
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.statsDone == done {
+			current := stats
+			s.stats = &current
+		}
+	}
+}
+
+// Status returns the state of the gzserver process and its world
+func (s *Simulation) Status() simulationStatus {
+	status := simulationStatus{processStatus: s.gzserver.Status()}
+	if status.State != processRunning {
+		return status
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status.World = s.world
+	status.TargetRealTimeFactor = s.targetRTF
+	if s.stats != nil {
+		stats := *s.stats
+		status.Paused = &stats.Paused
+		status.SimTime = &stats.SimTime
+		status.Iterations = &stats.Iterations
+		status.RealTimeFactor = &stats.RealTimeFactor
+	}
+	return status
+}
+
+// worldName returns the name of the world of the running gzserver
+func (s *Simulation) worldName() (string, error) {
+	if !s.Running() {
+		return "", errNotRunning
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.world == "" {
+		return "", errNotRunning
+	}
+	return s.world, nil
+}
+
+// worldCommand runs gz world with the args for the running world
+func (s *Simulation) worldCommand(arg ...string) error {
+	world, err := s.worldName()
+	if err != nil {
+		return err
+	}
+	return s.runner.Run("gz world: ", controlTimeout, "gz", append([]string{"world", "-w", world}, arg...)...)
+}
+
+// Pause stops the simulation time
+func (s *Simulation) Pause() error {
+	return s.setPaused(true)
+}
+
+// Resume continues the paused simulation
+func (s *Simulation) Resume() error {
+	return s.setPaused(false)
+}
+
+func (s *Simulation) setPaused(paused bool) error {
+	arg := "0"
+	if paused {
+		arg = "1"
+	}
+	err := s.worldCommand("-p", arg)
+	if err != nil {
+		return err
+	}
+	// shown before the next statistics arrive
+	s.lock.Lock()
+	if s.stats != nil {
+		s.stats.Paused = paused
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+// Step advances the paused simulation by iterations physics steps
+func (s *Simulation) Step(iterations int) error {
+	s.lock.Lock()
+	running := s.stats != nil && !s.stats.Paused
+	s.lock.Unlock()
+	if running {
+		return errNotPaused
+	}
+	if iterations == 1 {
+		return s.worldCommand("-s")
+	}
+	return s.worldCommand("-m", strconv.Itoa(iterations))
+}
+
+// Reset sets the simulation time to zero and moves the models to their
+// initial poses
+func (s *Simulation) Reset() error {
+	return s.worldCommand("-r")
+}
+
+// SetRealTimeFactor sets the target real time factor of the physics, zero
+// runs the simulation as fast as possible
+func (s *Simulation) SetRealTimeFactor(rtf float64) error {
+	world, err := s.worldName()
+	if err != nil {
+		return err
+	}
+	// the real time factor is the step size times the steps per second
+	stepSize := defaultStepSize
+	w, err := readWorld(s.gzserver.Status().WorldFile)
+	if err != nil {
+		log.Printf("Could not read step size of the world: %v", err)
+	} else if w.MaxStepSize > 0 {
+		stepSize = w.MaxStepSize
+	}
+	err = s.runner.Run("gz physics: ", controlTimeout, "gz", "physics", "-w", world,
+		"-s", strconv.FormatFloat(stepSize, 'f', -1, 64),
+		"-u", strconv.FormatFloat(rtf/stepSize, 'f', -1, 64))
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.targetRTF = &rtf
+	s.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseWorldStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		want   worldStats
+		wantOK bool
+	}{
+		{
+			name:   "running",
+			line:   `sim_time { sec: 12 nsec: 344000000 } pause_time { sec: 0 nsec: 0 } real_time { sec: 14 nsec: 484117315 } paused: false iterations: 12344 model_count: 3`,
+			want:   worldStats{SimTime: 12.344, RealTime: 14.484117315, Iterations: 12344},
+			wantOK: true,
+		},
+		{
+			name:   "paused",
+			line:   `sim_time { sec: 30 nsec: 4000000 } pause_time { sec: 5 nsec: 120000000 } real_time { sec: 35 nsec: 200000000 } paused: true iterations: 30004 model_count: 3`,
+			want:   worldStats{Paused: true, SimTime: 30.004, RealTime: 35.2, Iterations: 30004},
+			wantOK: true,
+		},
+		{
+			// the header stamp is not the sim time
+			name:   "header",
+			line:   `header { stamp { sec: 99 nsec: 1 } } sim_time { sec: 1 nsec: 500000000 } pause_time { sec: 0 nsec: 0 } real_time { sec: 2 nsec: 0 } paused: false iterations: 1500`,
+			want:   worldStats{SimTime: 1.5, RealTime: 2, Iterations: 1500},
+			wantOK: true,
+		},
+		{
+			name:   "omitted zero fields",
+			line:   `sim_time { nsec: 4000000 } pause_time { } real_time { sec: 1 } iterations: 4`,
+			want:   worldStats{SimTime: 0.004, RealTime: 1, Iterations: 4},
+			wantOK: true,
+		},
+		{
+			name:   "start",
+			line:   `sim_time { } pause_time { } real_time { } paused: true`,
+			want:   worldStats{Paused: true},
+			wantOK: true,
+		},
+		{
+			name: "no sim time",
+			line: `real_time { sec: 1 nsec: 0 } paused: false iterations: 4`,
+		},
+		{
+			name: "other output",
+			line: `Unable to get topic info`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := parseWorldStats(test.line)
+			if ok != test.wantOK {
+				t.Fatalf("parseWorldStats ok = %v, want %v", ok, test.wantOK)
+			}
+			if got.Paused != test.want.Paused || got.Iterations != test.want.Iterations ||
+				math.Abs(got.SimTime-test.want.SimTime) > 1e-9 || math.Abs(got.RealTime-test.want.RealTime) > 1e-9 {
+				t.Errorf("parseWorldStats = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMsgTime(t *testing.T) {
+	tests := []struct {
+		line   string
+		want   float64
+		wantOK bool
+	}{
+		{`sim_time { sec: 3 nsec: 250000000 }`, 3.25, true},
+		{`sim_time { sec: 3 }`, 3, true},
+		{`sim_time { nsec: 1 }`, 1e-9, true},
+		{`sim_time { }`, 0, true},
+		{`sim_time { sec: -1 nsec: 500000000 }`, -0.5, true},
+		// the nsec of another field is not used
+		{`sim_time { sec: 3 } real_time { nsec: 5 }`, 3, true},
+		{`real_time { sec: 3 }`, 0, false},
+		{`old_sim_time { sec: 3 }`, 0, false},
+	}
+	for _, test := range tests {
+		got, ok := parseMsgTime(simTimePattern, test.line)
+		if ok != test.wantOK || math.Abs(got-test.want) > 1e-12 {
+			t.Errorf("parseMsgTime(%s) = %g, %v, want %g, %v", test.line, got, ok, test.want, test.wantOK)
+		}
+	}
+}
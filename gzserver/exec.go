@@ -2,21 +2,85 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"sync"
 	"syscall"
+	"time"
 )
 
-func logPipe(logger *log.Logger, pipe io.ReadCloser) {
+// logTail keeps the last lines of a command output
+type logTail struct {
+	lock  sync.Mutex
+	lines []string
+	max   int
+}
+
+func newLogTail(max int) *logTail {
+	return &logTail{max: max}
+}
+
+func (t *logTail) add(line string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+// Lines returns the kept lines, oldest first
+func (t *logTail) Lines() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return append([]string{}, t.lines...)
+}
+
+func logPipe(logger *log.Logger, pipe io.ReadCloser, tail *logTail) {
 	scanner := bufio.NewScanner(pipe)
 	for scanner.Scan() {
 		logger.Print(scanner.Text())
+		if tail != nil {
+			tail.add(scanner.Text())
+		}
 	}
 }
 
 func startCommandWithLogging(logPrefix string, name string, arg ...string) (*exec.Cmd, error) {
+	return startCommandWithLogTail(logPrefix, nil, name, arg...)
+}
+
+// startCommandWithLogTail is startCommandWithLogging that also keeps the
+// last lines of the output in tail
+func startCommandWithLogTail(logPrefix string, tail *logTail, name string, arg ...string) (*exec.Cmd, error) {
+	cmd := exec.Command(name, arg...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	go logPipe(log.New(os.Stdout, logPrefix, log.LstdFlags), stdout, tail)
+	go logPipe(log.New(os.Stderr, logPrefix, log.LstdFlags), stderr, tail)
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// startCommandWithLineHandler starts the command and calls handle with each
+// line of its standard output, the standard error is logged
+func startCommandWithLineHandler(logPrefix string, handle func(line string), name string, arg ...string) (*exec.Cmd, error) {
 	cmd := exec.Command(name, arg...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	stdout, err := cmd.StdoutPipe()
@@ -27,11 +91,112 @@ func startCommandWithLogging(logPrefix string, name string, arg ...string) (*exe
 	if err != nil {
 		return nil, err
 	}
-	go logPipe(log.New(os.Stdout, logPrefix, log.LstdFlags), stdout)
-	go logPipe(log.New(os.Stderr, logPrefix, log.LstdFlags), stderr)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		// the pose messages of big worlds are long
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			handle(scanner.Text())
+		}
+	}()
+	go logPipe(log.New(os.Stderr, logPrefix, log.LstdFlags), stderr, nil)
 	err = cmd.Start()
 	if err != nil {
 		return nil, err
 	}
 	return cmd, nil
 }
+
+// runCommandWithLogging runs the command and waits for it to finish. The
+// command is killed after timeout.
+func runCommandWithLogging(logPrefix string, timeout time.Duration, name string, arg ...string) error {
+	cmd, err := startCommandWithLogging(logPrefix, name, arg...)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return fmt.Errorf("timeout after %v", timeout)
+	case err := <-done:
+		return err
+	}
+}
+
+// commandRunner runs the external commands of the simulation, so that the
+// simulation can be driven without Gazebo
+type commandRunner interface {
+	// Start starts the command in its own process group, the output is
+	// logged and kept in tail if not nil
+	Start(logPrefix string, tail *logTail, name string, arg ...string) (process, error)
+	// Run runs the command and kills it after timeout, the output is logged
+	Run(logPrefix string, timeout time.Duration, name string, arg ...string) error
+	// Output runs the command and returns its standard output
+	Output(timeout time.Duration, name string, arg ...string) ([]byte, error)
+	// Follow starts the command in its own process group and calls handle
+	// with each line of its standard output
+	Follow(logPrefix string, handle func(line string), name string, arg ...string) (process, error)
+}
+
+// process is a command started by a commandRunner
+type process interface {
+	Pid() int
+	// Wait waits for the process to exit and returns its exit code, -1 if
+	// it was killed by a signal
+	Wait() (int, error)
+	// Kill kills the process group
+	Kill() error
+}
+
+// execRunner runs the commands with os/exec
+type execRunner struct{}
+
+func (execRunner) Start(logPrefix string, tail *logTail, name string, arg ...string) (process, error) {
+	cmd, err := startCommandWithLogTail(logPrefix, tail, name, arg...)
+	if err != nil {
+		return nil, err
+	}
+	return &execProcess{cmd}, nil
+}
+
+func (execRunner) Run(logPrefix string, timeout time.Duration, name string, arg ...string) error {
+	return runCommandWithLogging(logPrefix, timeout, name, arg...)
+}
+
+func (execRunner) Output(timeout time.Duration, name string, arg ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return exec.CommandContext(ctx, name, arg...).Output()
+}
+
+func (execRunner) Follow(logPrefix string, handle func(line string), name string, arg ...string) (process, error) {
+	cmd, err := startCommandWithLineHandler(logPrefix, handle, name, arg...)
+	if err != nil {
+		return nil, err
+	}
+	return &execProcess{cmd}, nil
+}
+
+type execProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p *execProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p *execProcess) Wait() (int, error) {
+	err := p.cmd.Wait()
+	if p.cmd.ProcessState == nil {
+		return -1, err
+	}
+	return p.cmd.ProcessState.ExitCode(), err
+}
+
+func (p *execProcess) Kill() error {
+	return syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+}
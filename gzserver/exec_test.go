@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRunner is a commandRunner that records the commands instead of
+// running them
+type fakeRunner struct {
+	lock  sync.Mutex
+	calls []string
+	procs []*fakeProcess
+	// startErr is returned by Start
+	startErr error
+	// runErrs are the errors returned by Run by command name
+	runErrs map[string]error
+	// output is returned by Output
+	output string
+}
+
+func newFakeRunner() *fakeRunner {
+	return &fakeRunner{runErrs: make(map[string]error)}
+}
+
+func (r *fakeRunner) record(name string, arg []string) {
+	r.calls = append(r.calls, strings.Join(append([]string{name}, arg...), " "))
+}
+
+func (r *fakeRunner) Start(logPrefix string, tail *logTail, name string, arg ...string) (process, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.record(name, arg)
+	if r.startErr != nil {
+		return nil, r.startErr
+	}
+	proc := newFakeProcess(100 + len(r.procs))
+	r.procs = append(r.procs, proc)
+	return proc, nil
+}
+
+func (r *fakeRunner) Run(logPrefix string, timeout time.Duration, name string, arg ...string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.record(name, arg)
+	return r.runErrs[name]
+}
+
+func (r *fakeRunner) Output(timeout time.Duration, name string, arg ...string) ([]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.record(name, arg)
+	return []byte(r.output), nil
+}
+
+func (r *fakeRunner) Follow(logPrefix string, handle func(line string), name string, arg ...string) (process, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.record(name, arg)
+	return newFakeProcess(0), nil
+}
+
+// Calls returns the recorded commands with their arguments
+func (r *fakeRunner) Calls() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]string{}, r.calls...)
+}
+
+// Process returns the i:th process started
+func (r *fakeRunner) Process(i int) *fakeProcess {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.procs[i]
+}
+
+// fakeProcess runs until it is killed or exit is called
+type fakeProcess struct {
+	pid    int
+	once   sync.Once
+	exited chan struct{}
+	code   int
+	err    error
+}
+
+func newFakeProcess(pid int) *fakeProcess {
+	return &fakeProcess{pid: pid, exited: make(chan struct{})}
+}
+
+func (p *fakeProcess) Pid() int {
+	return p.pid
+}
+
+func (p *fakeProcess) Wait() (int, error) {
+	<-p.exited
+	return p.code, p.err
+}
+
+func (p *fakeProcess) Kill() error {
+	p.exit(-1, errors.New("signal: killed"))
+	return nil
+}
+
+// exit ends the process with the exit code and the error of Wait
+func (p *fakeProcess) exit(code int, err error) {
+	p.once.Do(func() {
+		p.code = code
+		p.err = err
+		close(p.exited)
+	})
+}
+
+func TestLogTail(t *testing.T) {
+	tests := []struct {
+		name  string
+		max   int
+		lines []string
+		want  []string
+	}{
+		{"empty", 3, nil, []string{}},
+		{"fewer than max", 3, []string{"a", "b"}, []string{"a", "b"}},
+		{"max", 3, []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"more than max", 3, []string{"a", "b", "c", "d", "e"}, []string{"c", "d", "e"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tail := newLogTail(test.max)
+			for _, line := range test.lines {
+				tail.add(line)
+			}
+			got := tail.Lines()
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Lines() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
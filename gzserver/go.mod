@@ -9,6 +9,7 @@ require (
 	k8s.io/apimachinery v0.19.3
 	k8s.io/client-go v11.0.0+incompatible
 	k8s.io/utils v0.0.0-20201104234853-8146046b121e // indirect
+	nhooyr.io/websocket v1.8.6
 )
 
 replace (
@@ -1,15 +1,42 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+var (
+	mavlinkUDPPorts = flag.String("mavlink-udp-ports", "14560-14659", "Range of the allocated MAVLink UDP ports")
+	mavlinkTCPPorts = flag.String("mavlink-tcp-ports", "4560-4659", "Range of the allocated MAVLink TCP ports")
+	videoUDPPorts   = flag.String("video-udp-ports", "5600-5699", "Range of the allocated video UDP ports")
+	worldsDir       = flag.String("worlds-dir", "/data/worlds", "Directory of the world files")
+	streamOrigins   = flag.String("stream-origins", "", "Comma separated host patterns of the allowed cross origin stream requests")
+)
+
 func main() {
+	flag.Parse()
 	port := "8081"
 
+	var ranges []portRange
+	for _, s := range []string{*mavlinkUDPPorts, *mavlinkTCPPorts, *videoUDPPorts} {
+		r, err := parsePortRange(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ranges = append(ranges, r)
+	}
+	simulation = NewSimulation(execRunner{}, NewPortPool(ranges[0], ranges[1], ranges[2]))
+	worlds = &worldStore{dir: *worldsDir}
+	for _, origin := range strings.Split(*streamOrigins, ",") {
+		if origin != "" {
+			streamOriginPatterns = append(streamOriginPatterns, origin)
+		}
+	}
+
 	router := httprouter.New()
 	registerRoutes(router)
 
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errPortInUse = errors.New("port in use")
+var errPortsExhausted = errors.New("no free ports")
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	first int32
+	last  int32
+}
+
+// parsePortRange parses <first>-<last> port ranges
+func parsePortRange(s string) (portRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return portRange{}, fmt.Errorf("port range '%s' is not <first>-<last>", s)
+	}
+	first, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("port range '%s': %w", s, err)
+	}
+	last, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("port range '%s': %w", s, err)
+	}
+	if first == 0 || first > last {
+		return portRange{}, fmt.Errorf("port range '%s' is empty", s)
+	}
+	return portRange{first: int32(first), last: int32(last)}, nil
+}
+
+func (r portRange) String() string {
+	return fmt.Sprintf("%d-%d", r.first, r.last)
+}
+
+// portPool hands out the MAVLink and video ports of the drones. The ports
+// given in the requests may be outside the ranges but they are reserved the
+// same way. The pool is not safe for concurrent use.
+type portPool struct {
+	mavlinkUDP portRange
+	mavlinkTCP portRange
+	videoUDP   portRange
+	// used has the device ids by reserved port
+	used map[int32]string
+}
+
+func NewPortPool(mavlinkUDP portRange, mavlinkTCP portRange, videoUDP portRange) *portPool {
+	return &portPool{
+		mavlinkUDP: mavlinkUDP,
+		mavlinkTCP: mavlinkTCP,
+		videoUDP:   videoUDP,
+		used:       make(map[int32]string),
+	}
+}
+
+// Reserve reserves the ports of the drone. The ports left zero are
+// allocated from the ranges, nothing is reserved on error.
+func (p *portPool) Reserve(spec *droneSpec) error {
+	given := make(map[int32]bool)
+	for _, port := range []int32{spec.MAVLinkUDPPort, spec.MAVLinkTCPPort, spec.VideoUDPPort} {
+		if port == 0 {
+			continue
+		}
+		if given[port] {
+			return fmt.Errorf("%w: %d is given more than once", errPortInUse, port)
+		}
+		if deviceID, ok := p.used[port]; ok {
+			return fmt.Errorf("%w: %d is used by drone %s", errPortInUse, port, deviceID)
+		}
+		given[port] = true
+	}
+
+	ports := []*int32{&spec.MAVLinkUDPPort, &spec.MAVLinkTCPPort, &spec.VideoUDPPort}
+	ranges := []portRange{p.mavlinkUDP, p.mavlinkTCP, p.videoUDP}
+	allocated := make([]int32, len(ports))
+	for i, port := range ports {
+		if *port != 0 {
+			allocated[i] = *port
+			continue
+		}
+		free := p.free(ranges[i], given)
+		if free == 0 {
+			return fmt.Errorf("%w in range %s", errPortsExhausted, ranges[i])
+		}
+		allocated[i] = free
+		given[free] = true
+	}
+
+	for i, port := range ports {
+		*port = allocated[i]
+		p.used[*port] = spec.DeviceID
+	}
+	return nil
+}
+
+// free returns the first port of the range that is not used or taken, or
+// zero if there is none
+func (p *portPool) free(r portRange, taken map[int32]bool) int32 {
+	for port := r.first; port <= r.last; port++ {
+		if _, ok := p.used[port]; !ok && !taken[port] {
+			return port
+		}
+	}
+	return 0
+}
+
+// Release frees the ports of the drone
+func (p *portPool) Release(spec droneSpec) {
+	for _, port := range []int32{spec.MAVLinkUDPPort, spec.MAVLinkTCPPort, spec.VideoUDPPort} {
+		if p.used[port] == spec.DeviceID {
+			delete(p.used, port)
+		}
+	}
+}
+
+// Reset frees all ports
+func (p *portPool) Reset() {
+	p.used = make(map[int32]string)
+}
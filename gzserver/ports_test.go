@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    portRange
+		wantErr bool
+	}{
+		{in: "14560-14660", want: portRange{first: 14560, last: 14660}},
+		{in: "5600-5600", want: portRange{first: 5600, last: 5600}},
+		{in: "5600", wantErr: true},
+		{in: "5600-", wantErr: true},
+		{in: "a-b", wantErr: true},
+		{in: "0-10", wantErr: true},
+		{in: "20-10", wantErr: true},
+		{in: "1-65536", wantErr: true},
+		{in: "1-2-3", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			got, err := parsePortRange(test.in)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parsePortRange = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("parsePortRange = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPortPoolReserve(t *testing.T) {
+	tests := []struct {
+		name      string
+		reserved  []droneSpec
+		spec      droneSpec
+		wantErr   error
+		wantPorts [3]int32
+	}{
+		{
+			name:      "allocated",
+			spec:      droneSpec{DeviceID: "d1"},
+			wantPorts: [3]int32{14560, 4560, 5600},
+		},
+		{
+			name:      "given outside ranges",
+			spec:      droneSpec{DeviceID: "d1", MAVLinkUDPPort: 1000, MAVLinkTCPPort: 1001, VideoUDPPort: 1002},
+			wantPorts: [3]int32{1000, 1001, 1002},
+		},
+		{
+			name:      "given in range is skipped by allocation",
+			spec:      droneSpec{DeviceID: "d1", MAVLinkTCPPort: 14560},
+			wantPorts: [3]int32{14561, 14560, 5600},
+		},
+		{
+			name:      "next free",
+			reserved:  []droneSpec{{DeviceID: "d0"}},
+			spec:      droneSpec{DeviceID: "d1"},
+			wantPorts: [3]int32{14561, 4561, 5601},
+		},
+		{
+			name:      "given twice",
+			spec:      droneSpec{DeviceID: "d1", MAVLinkUDPPort: 1000, VideoUDPPort: 1000},
+			wantErr:   errPortInUse,
+			wantPorts: [3]int32{1000, 0, 1000},
+		},
+		{
+			name:      "given in use",
+			reserved:  []droneSpec{{DeviceID: "d0"}},
+			spec:      droneSpec{DeviceID: "d1", VideoUDPPort: 5600},
+			wantErr:   errPortInUse,
+			wantPorts: [3]int32{0, 0, 5600},
+		},
+		{
+			name:     "exhausted",
+			reserved: []droneSpec{{DeviceID: "d0"}, {DeviceID: "d1"}},
+			spec:     droneSpec{DeviceID: "d2"},
+			wantErr:  errPortsExhausted,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := NewPortPool(
+				portRange{first: 14560, last: 14561},
+				portRange{first: 4560, last: 4561},
+				portRange{first: 5600, last: 5601})
+			for i := range test.reserved {
+				err := pool.Reserve(&test.reserved[i])
+				if err != nil {
+					t.Fatalf("Reserve %s: %v", test.reserved[i].DeviceID, err)
+				}
+			}
+			used := len(pool.used)
+
+			spec := test.spec
+			err := pool.Reserve(&spec)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Reserve = %v, want %v", err, test.wantErr)
+			}
+			got := [3]int32{spec.MAVLinkUDPPort, spec.MAVLinkTCPPort, spec.VideoUDPPort}
+			if got != test.wantPorts {
+				t.Errorf("ports = %v, want %v", got, test.wantPorts)
+			}
+			if err != nil && len(pool.used) != used {
+				t.Errorf("%d ports used after error, want %d", len(pool.used), used)
+			}
+		})
+	}
+}
+
+func TestPortPoolRelease(t *testing.T) {
+	pool := NewPortPool(
+		portRange{first: 14560, last: 14561},
+		portRange{first: 4560, last: 4561},
+		portRange{first: 5600, last: 5601})
+	d0 := droneSpec{DeviceID: "d0"}
+	d1 := droneSpec{DeviceID: "d1"}
+	for _, spec := range []*droneSpec{&d0, &d1} {
+		err := pool.Reserve(spec)
+		if err != nil {
+			t.Fatalf("Reserve %s: %v", spec.DeviceID, err)
+		}
+	}
+
+	// only the ports reserved by the drone are freed
+	other := d1
+	other.DeviceID = "d0"
+	pool.Release(other)
+	if len(pool.used) != 6 {
+		t.Errorf("%d ports used after releasing the ports of another drone, want 6", len(pool.used))
+	}
+
+	pool.Release(d0)
+	if len(pool.used) != 3 {
+		t.Errorf("%d ports used after release, want 3", len(pool.used))
+	}
+	again := droneSpec{DeviceID: "d2"}
+	err := pool.Reserve(&again)
+	if err != nil || again.MAVLinkUDPPort != 14560 {
+		t.Errorf("Reserve after release = %v with port %d, want 14560", err, again.MAVLinkUDPPort)
+	}
+
+	pool.Reset()
+	if len(pool.used) != 0 {
+		t.Errorf("%d ports used after reset", len(pool.used))
+	}
+}
@@ -1,38 +1,58 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"os/exec"
-	"syscall"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"nhooyr.io/websocket"
 )
 
 func registerRoutes(router *httprouter.Router) {
+	router.HandlerFunc(http.MethodGet, "/simulation", getSimulationHandler)
 	router.HandlerFunc(http.MethodPost, "/simulation/start", startSimulationHandler)
 	router.HandlerFunc(http.MethodPost, "/simulation/stop", stopSimulationHandler)
+	router.HandlerFunc(http.MethodPost, "/simulation/pause", pauseSimulationHandler)
+	router.HandlerFunc(http.MethodPost, "/simulation/resume", resumeSimulationHandler)
+	router.HandlerFunc(http.MethodPost, "/simulation/step", stepSimulationHandler)
+	router.HandlerFunc(http.MethodPost, "/simulation/reset", resetSimulationHandler)
+	router.HandlerFunc(http.MethodPost, "/simulation/real_time_factor", realTimeFactorHandler)
+	router.HandlerFunc(http.MethodGet, "/simulation/stream", streamSimulationHandler)
 
 	router.HandlerFunc(http.MethodGet, "/simulation/drones", listDronesHandler)
 	router.HandlerFunc(http.MethodPost, "/simulation/drones", createDroneHandler)
 	router.HandlerFunc(http.MethodDelete, "/simulation/drones/:id", deleteDroneHandler)
-}
+	router.HandlerFunc(http.MethodPost, "/simulation/swarms", createSwarmHandler)
 
-type Drone struct {
-	Location string
+	router.HandlerFunc(http.MethodGet, "/worlds", listWorldsHandler)
+	router.HandlerFunc(http.MethodPost, "/worlds", createWorldHandler)
+	router.HandlerFunc(http.MethodDelete, "/worlds/:name", deleteWorldHandler)
 }
 
-var (
-	gzserverCmd *exec.Cmd
-	drones      map[string]*Drone = make(map[string]*Drone)
-)
+// defaultStartTimeout is the time gzserver has to load the world
+const defaultStartTimeout = 60 * time.Second
+
+var simulation *Simulation
+var worlds *worldStore
+
+// streamOriginPatterns are the host patterns of the allowed cross origin
+// stream requests, the dashboards served from other origins must be listed
+var streamOriginPatterns []string
+
+func getSimulationHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, simulation.Status())
+}
 
 func startSimulationHandler(w http.ResponseWriter, r *http.Request) {
-	if gzserverCmd != nil {
+	if simulation.Running() {
 		log.Printf("Simulation already running")
 		http.Error(w, "Simulation already running", http.StatusBadRequest)
 		return
@@ -40,6 +60,10 @@ func startSimulationHandler(w http.ResponseWriter, r *http.Request) {
 
 	var requestBody struct {
 		WorldFile string `json:"world_file"`
+		// AutoRestart starts gzserver again if it crashes
+		AutoRestart bool `json:"auto_restart"`
+		// Timeout of loading the world in seconds
+		Timeout int `json:"timeout"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&requestBody)
@@ -50,72 +74,220 @@ func startSimulationHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("Starting simulation")
 
-	worldFile := requestBody.WorldFile
-	if len(worldFile) == 0 {
-		worldFile = "empty.world"
+	worldName := requestBody.WorldFile
+	if len(worldName) == 0 {
+		worldName = "empty.world"
 	}
 
-	worldFile = fmt.Sprintf("/data/worlds/%s", worldFile)
+	worldFile, err := worlds.Resolve(worldName)
+	if err == errInvalidWorldName {
+		http.Error(w, "Invalid world name", http.StatusBadRequest)
+		return
+	}
+	if err == errWorldNotFound {
+		http.Error(w, "World not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not resolve world %s: %v", worldName, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 
-	gzserverCmd, err = startCommandWithLogging("gzserver: ", "bash", "-c", fmt.Sprintf("/gzserver-api/scripts/launch-gzserver.sh %s", worldFile))
+	err = simulation.Start(worldFile, requestBody.AutoRestart)
+	if err == errAlreadyRunning {
+		http.Error(w, "Simulation already running", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Could not start gzserver: %v", err)
+		http.Error(w, "Could not start gzserver", http.StatusInternalServerError)
+		return
+	}
+
+	timeout := defaultStartTimeout
+	if requestBody.Timeout > 0 {
+		timeout = time.Duration(requestBody.Timeout) * time.Second
+	}
+	startErr := simulation.WaitReady(timeout)
+	if startErr != nil {
+		log.Printf("Simulation startup failed: %s", startErr.Error)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(startErr.status)
+		writeJSON(w, startErr)
+		return
 	}
+	log.Printf("Simulation started")
+
+	writeJSON(w, simulation.Status())
 }
 func stopSimulationHandler(w http.ResponseWriter, r *http.Request) {
-	if gzserverCmd == nil {
+	log.Printf("Stopping simulation")
+	err := simulation.Stop()
+	if err == errNotRunning {
 		log.Printf("Simulation not running")
 		http.Error(w, "Simulation not running", http.StatusBadRequest)
 		return
 	}
-	log.Printf("Stopping simulation")
-	syscall.Kill(-gzserverCmd.Process.Pid, syscall.SIGKILL)
-	gzserverCmd = nil
+	if err != nil {
+		log.Printf("Could not stop gzserver: %v", err)
+		http.Error(w, "Could not stop gzserver", http.StatusInternalServerError)
+		return
+	}
 }
 
-func listDronesHandler(w http.ResponseWriter, r *http.Request) {
-	if gzserverCmd == nil {
+func pauseSimulationHandler(w http.ResponseWriter, r *http.Request) {
+	controlSimulation(w, "pause", simulation.Pause)
+}
+
+func resumeSimulationHandler(w http.ResponseWriter, r *http.Request) {
+	controlSimulation(w, "resume", simulation.Resume)
+}
+
+func stepSimulationHandler(w http.ResponseWriter, r *http.Request) {
+	iterations := 1
+	if s := r.URL.Query().Get("iterations"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "Iterations must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		iterations = n
+	}
+	controlSimulation(w, "step", func() error {
+		return simulation.Step(iterations)
+	})
+}
+
+func resetSimulationHandler(w http.ResponseWriter, r *http.Request) {
+	controlSimulation(w, "reset", simulation.Reset)
+}
+
+func realTimeFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		// RealTimeFactor is the target real time factor, 0 runs the
+		// simulation as fast as possible
+		RealTimeFactor *float64 `json:"real_time_factor"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		log.Printf("Could not decode body: %v", err)
+		http.Error(w, "Malformatted body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.RealTimeFactor == nil || *requestBody.RealTimeFactor < 0 {
+		http.Error(w, "A non-negative real_time_factor is required", http.StatusBadRequest)
+		return
+	}
+	rtf := *requestBody.RealTimeFactor
+	controlSimulation(w, "real time factor", func() error {
+		return simulation.SetRealTimeFactor(rtf)
+	})
+}
+
+// controlSimulation runs the control command and responds with the state of
+// the simulation
+func controlSimulation(w http.ResponseWriter, action string, command func() error) {
+	err := command()
+	if err == errNotRunning {
 		log.Printf("Simulation not running")
 		http.Error(w, "Simulation not running", http.StatusBadRequest)
 		return
 	}
+	if err == errNotPaused {
+		http.Error(w, "Simulation not paused", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Simulation %s failed: %v", action, err)
+		http.Error(w, fmt.Sprintf("Simulation %s failed", action), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Simulation %s done", action)
+	writeJSON(w, simulation.Status())
+}
 
-	type drone struct {
-		DeviceID      string `json:"device_id"`
-		DroneLocation string `json:"drone_location"`
+func streamSimulationHandler(w http.ResponseWriter, r *http.Request) {
+	interval := defaultStreamInterval
+	if s := r.URL.Query().Get("interval"); s != "" {
+		ms, err := strconv.Atoi(s)
+		if err != nil || time.Duration(ms)*time.Millisecond < minStreamInterval {
+			http.Error(w, fmt.Sprintf("Interval must be at least %d milliseconds", minStreamInterval.Milliseconds()), http.StatusBadRequest)
+			return
+		}
+		interval = time.Duration(ms) * time.Millisecond
+	}
+	// device ids can be given as device_id=a&device_id=b or device_id=a,b
+	deviceIDs := make(map[string]bool)
+	for _, value := range r.URL.Query()["device_id"] {
+		for _, id := range strings.Split(value, ",") {
+			if id != "" {
+				deviceIDs[id] = true
+			}
+		}
 	}
 
-	droneList := make([]drone, 0)
-	for id, d := range drones {
-		droneList = append(droneList, drone{
-			DeviceID:      id,
-			DroneLocation: d.Location,
-		})
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		OriginPatterns: streamOriginPatterns,
+	})
+	if err != nil {
+		log.Printf("Unable to accept websocket: %v", err)
+		return
+	}
+	defer conn.Close(websocket.StatusInternalError, "")
+	// the clients only receive, CloseRead handles their close messages
+	c := conn.CloseRead(r.Context())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		msg, err := json.Marshal(simulation.Frame(deviceIDs))
+		if err != nil {
+			log.Printf("Could not marshal stream frame: %v", err)
+			return
+		}
+		err = writeTimeout(c, 2*time.Second, conn, msg)
+		if err != nil {
+			if websocket.CloseStatus(err) == websocket.StatusNormalClosure ||
+				websocket.CloseStatus(err) == websocket.StatusGoingAway || c.Err() != nil {
+				return
+			}
+			log.Printf("Write to websocket failed: %v", err)
+			return
+		}
+
+		select {
+		case <-c.Done():
+			return
+		case <-ticker.C:
+		}
 	}
+}
+
+func writeTimeout(c context.Context, timeout time.Duration, conn *websocket.Conn, msg []byte) error {
+	c, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
 
-	writeJSON(w, droneList)
+	return conn.Write(c, websocket.MessageText, msg)
 }
 
-func createDroneHandler(w http.ResponseWriter, r *http.Request) {
-	if gzserverCmd == nil {
+func listDronesHandler(w http.ResponseWriter, r *http.Request) {
+	if !simulation.Running() {
 		log.Printf("Simulation not running")
 		http.Error(w, "Simulation not running", http.StatusBadRequest)
 		return
 	}
-	var requestBody struct {
-		DroneLocation  string  `json:"drone_location"`
-		DeviceID       string  `json:"device_id"`
-		MAVLinkAddress string  `json:"mavlink_address"`
-		MAVLinkUDPPort int32   `json:"mavlink_udp_port"`
-		MAVLinkTCPPort int32   `json:"mavlink_tcp_port"`
-		VideoUDPPort   int32   `json:"video_udp_port"`
-		PosX           float64 `json:"pos_x"`
-		PosY           float64 `json:"pos_y"`
-		PosZ           float64 `json:"pos_z"`
-		Pitch          float64 `json:"pitch"`
-		Yaw            float64 `json:"yaw"`
-		Roll           float64 `json:"roll"`
+
+	writeJSON(w, simulation.Drones())
+}
+
+func createDroneHandler(w http.ResponseWriter, r *http.Request) {
+	if !simulation.Running() {
+		log.Printf("Simulation not running")
+		http.Error(w, "Simulation not running", http.StatusBadRequest)
+		return
 	}
+	var requestBody droneSpec
 
 	err := json.NewDecoder(r.Body).Decode(&requestBody)
 	if err != nil {
@@ -124,13 +296,6 @@ func createDroneHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, ok := drones[requestBody.DeviceID]
-	if ok {
-		log.Printf("Request to add drone with device id already in use")
-		http.Error(w, "DeviceID already in use", http.StatusBadRequest)
-		return
-	}
-
 	ips, err := net.LookupIP(requestBody.MAVLinkAddress)
 	if err != nil {
 		log.Printf("Could not lookup mavlink IP '%s': %v", requestBody.MAVLinkAddress, err)
@@ -142,50 +307,187 @@ func createDroneHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Cloud not lookup mavlink IP", http.StatusInternalServerError)
 		return
 	}
-	command := fmt.Sprintf("/gzserver-api/scripts/spawn-drone.sh %s %d %d %d %s %f %f %f %f %f %f",
-		ips[0].String(),
-		requestBody.MAVLinkUDPPort,
-		requestBody.MAVLinkTCPPort,
-		requestBody.VideoUDPPort,
-		requestBody.DeviceID,
-		requestBody.PosX,
-		requestBody.PosY,
-		requestBody.PosZ,
-		requestBody.Yaw,
-		requestBody.Pitch,
-		requestBody.Roll)
 
-	// add drone model and connect it to the mavlink
-	droneSpawnCmd, err := startCommandWithLogging(fmt.Sprintf("drone (%s): ", requestBody.DeviceID), "bash", "-c", command)
+	drone, err := simulation.SpawnDrone(requestBody, ips[0].String())
+	if err == errInvalidDeviceID {
+		log.Printf("Request to add drone with invalid device id")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == errDroneExists {
+		log.Printf("Request to add drone with device id already in use")
+		http.Error(w, "DeviceID already in use", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errPortInUse) {
+		log.Printf("Request to add drone with port already in use: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errPortsExhausted) {
+		log.Printf("Could not allocate ports: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Spawn failed: %v", err)
+		http.Error(w, "Spawn failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, drone)
+}
+func deleteDroneHandler(w http.ResponseWriter, r *http.Request) {
+	if !simulation.Running() {
+		log.Printf("Simulation not running")
+		http.Error(w, "Simulation not running", http.StatusBadRequest)
+		return
+	}
+	deviceID := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	err := simulation.RemoveDrone(deviceID)
+	if err == errDroneNotFound {
+		http.Error(w, "Drone not found", http.StatusNotFound)
+		return
+	}
+	if err == errDroneBusy {
+		http.Error(w, "Drone is being spawned or removed", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not delete drone model of %s: %v", deviceID, err)
+		http.Error(w, "Could not delete drone model", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Removed drone %s", deviceID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func createSwarmHandler(w http.ResponseWriter, r *http.Request) {
+	if !simulation.Running() {
+		log.Printf("Simulation not running")
+		http.Error(w, "Simulation not running", http.StatusBadRequest)
+		return
+	}
+	var requestBody swarmSpec
+
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
 	if err != nil {
-		log.Printf("Could not spawn drone model: %v", err)
-		http.Error(w, "Could not spawn drone model", http.StatusInternalServerError)
+		log.Printf("Could not decode body: %v", err)
+		http.Error(w, "Malformatted body", http.StatusBadRequest)
 		return
 	}
 
-	done := make(chan error)
-	go func() { done <- droneSpawnCmd.Wait() }()
-	select {
-	case <-time.After(20 * time.Second):
-		log.Printf("Spawn timeout after 20 seconds")
-		droneSpawnCmd.Process.Kill()
-	case err := <-done:
-		if err != nil {
-			log.Printf("Spawn failed: %v", err)
-			http.Error(w, "Spawn failed", http.StatusInternalServerError)
+	drones, err := planSwarm(requestBody, simulation.specs())
+	if err != nil {
+		log.Printf("Invalid swarm: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	concurrency := requestBody.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultSwarmConcurrency
+	}
+	if concurrency > maxSwarmConcurrency {
+		concurrency = maxSwarmConcurrency
+	}
+
+	log.Printf("Spawning swarm of %d drones", len(drones))
+	results := simulation.SpawnSwarm(drones, concurrency)
+	spawned := 0
+	for _, result := range results {
+		if result.State == droneSpawned {
+			spawned++
 		}
 	}
+	log.Printf("Spawned %d/%d swarm drones", spawned, len(results))
+
+	writeJSON(w, struct {
+		Spawned int           `json:"spawned"`
+		Failed  int           `json:"failed"`
+		Drones  []swarmResult `json:"drones"`
+	}{
+		Spawned: spawned,
+		Failed:  len(results) - spawned,
+		Drones:  results,
+	})
+}
 
-	drones[requestBody.DeviceID] = &Drone{
-		Location: requestBody.DroneLocation,
+func listWorldsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := worlds.List()
+	if err != nil {
+		log.Printf("Could not list worlds: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
+	writeJSON(w, list)
 }
-func deleteDroneHandler(w http.ResponseWriter, r *http.Request) {
-	if gzserverCmd == nil {
-		log.Printf("Simulation not running")
-		http.Error(w, "Simulation not running", http.StatusBadRequest)
+
+func createWorldHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxWorldSize+1<<20)
+	file, header, err := r.FormFile("world")
+	if err != nil {
+		log.Printf("Could not read uploaded world: %v", err)
+		http.Error(w, "World file is required in form field 'world'", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	name := r.FormValue("name")
+	if name == "" {
+		name = header.Filename
+	}
+	world, err := worlds.Add(name, file)
+	if err == errInvalidWorldName {
+		http.Error(w, "Invalid world name", http.StatusBadRequest)
+		return
+	}
+	if err == errWorldExists {
+		http.Error(w, "World already exists", http.StatusConflict)
+		return
+	}
+	if _, ok := err.(invalidWorldError); ok {
+		log.Printf("Rejected world %s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not save world %s: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Added world %s", name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, world)
+}
+
+func deleteWorldHandler(w http.ResponseWriter, r *http.Request) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+	path, err := worlds.Resolve(name)
+	if err == nil {
+		err = simulation.DeleteWorld(path, func() error {
+			return worlds.Delete(name)
+		})
+	}
+	if err == errWorldInUse {
+		http.Error(w, "World is used by the simulation", http.StatusConflict)
+		return
+	}
+	if err == errInvalidWorldName {
+		http.Error(w, "Invalid world name", http.StatusBadRequest)
+		return
+	}
+	if err == errWorldNotFound {
+		http.Error(w, "World not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not delete world %s: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	log.Printf("Deleted world %s", name)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func writeJSON(w http.ResponseWriter, data interface{}) {
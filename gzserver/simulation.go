@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// drone states
+const (
+	droneSpawning = "spawning"
+	droneSpawned  = "spawned"
+	droneFailed   = "failed"
+	droneRemoving = "removing"
+)
+
+// spawnTimeout is the time spawn-drone.sh has to add the drone model
+const spawnTimeout = 20 * time.Second
+
+// removeTimeout is the time gz has to delete the drone model
+const removeTimeout = 10 * time.Second
+
+// droneModelPrefix is prepended to the device id in the drone model names,
+// see spawn-drone.sh
+const droneModelPrefix = "ssrc_fog_x_"
+
+// deviceIDPattern matches the device ids of the drones, the device id is used
+// in the model name and in the path of its model file
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var errInvalidDeviceID = errors.New("device id must be 1-64 letters, digits, '_' or '-'")
+var errDroneExists = errors.New("device id already in use")
+var errDroneNotFound = errors.New("drone not found")
+var errDroneBusy = errors.New("drone is being spawned or removed")
+
+// droneSpec tells where the drone is added and how it connects to PX4
+type droneSpec struct {
+	DroneLocation  string  `json:"drone_location"`
+	DeviceID       string  `json:"device_id"`
+	MAVLinkAddress string  `json:"mavlink_address"`
+	MAVLinkUDPPort int32   `json:"mavlink_udp_port"`
+	MAVLinkTCPPort int32   `json:"mavlink_tcp_port"`
+	VideoUDPPort   int32   `json:"video_udp_port"`
+	PosX           float64 `json:"pos_x"`
+	PosY           float64 `json:"pos_y"`
+	PosZ           float64 `json:"pos_z"`
+	Pitch          float64 `json:"pitch"`
+	Yaw            float64 `json:"yaw"`
+	Roll           float64 `json:"roll"`
+}
+
+type Drone struct {
+	DeviceID       string `json:"device_id"`
+	Location       string `json:"drone_location"`
+	State          string `json:"state"`
+	Error          string `json:"error,omitempty"`
+	MAVLinkUDPPort int32  `json:"mavlink_udp_port"`
+	MAVLinkTCPPort int32  `json:"mavlink_tcp_port"`
+	VideoUDPPort   int32  `json:"video_udp_port"`
+	// spec the drone was spawned with, with the allocated ports
+	spec droneSpec
+}
+
+// Simulation owns the gzserver process and the drones added to its world.
+// The drones are forgotten and their ports freed when a new gzserver process
+// is started.
+type Simulation struct {
+	runner   commandRunner
+	gzserver *supervisor
+
+	lock   sync.Mutex
+	drones map[string]*Drone
+	ports  *portPool
+	// world is the name of the loaded Gazebo world
+	world string
+	// stats are the latest statistics of the world, nil until received
+	stats *worldStats
+	// poses are the latest poses of the drone models by device id
+	poses map[string]dronePose
+	// statsDone is closed when the process publishing stats exits
+	statsDone <-chan struct{}
+	// targetRTF is the real time factor set by SetRealTimeFactor
+	targetRTF *float64
+}
+
+func NewSimulation(runner commandRunner, ports *portPool) *Simulation {
+	s := &Simulation{
+		runner:   runner,
+		gzserver: NewSupervisor(runner),
+		drones:   make(map[string]*Drone),
+		ports:    ports,
+		poses:    make(map[string]dronePose),
+	}
+	// called with the supervisor lock held, s must not call the supervisor
+	// while holding its own lock
+	s.gzserver.onStart = func() {
+		s.lock.Lock()
+		s.drones = make(map[string]*Drone)
+		s.ports.Reset()
+		s.world = ""
+		s.stats = nil
+		s.poses = make(map[string]dronePose)
+		s.targetRTF = nil
+		s.lock.Unlock()
+	}
+	s.gzserver.onReady = s.ready
+	return s
+}
+
+// Start launches gzserver with the world file
+func (s *Simulation) Start(worldFile string, autoRestart bool) error {
+	return s.gzserver.Start(worldFile, autoRestart)
+}
+
+// WaitReady waits until gzserver has loaded the world
+func (s *Simulation) WaitReady(timeout time.Duration) *startupError {
+	return s.gzserver.WaitReady(timeout)
+}
+
+// Stop kills gzserver
+func (s *Simulation) Stop() error {
+	return s.gzserver.Stop()
+}
+
+// DeleteWorld calls remove unless the world file is used by gzserver
+func (s *Simulation) DeleteWorld(worldFile string, remove func() error) error {
+	return s.gzserver.RemoveWorld(worldFile, remove)
+}
+
+// Running reports whether gzserver is running
+func (s *Simulation) Running() bool {
+	return s.gzserver.Running()
+}
+
+// Drones returns the drones sorted by device id
+func (s *Simulation) Drones() []Drone {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	drones := make([]Drone, 0, len(s.drones))
+	for _, d := range s.drones {
+		drones = append(drones, *d)
+	}
+	sort.Slice(drones, func(i, j int) bool {
+		return drones[i].DeviceID < drones[j].DeviceID
+	})
+	return drones
+}
+
+// specs returns the specs of the drones in the world
+func (s *Simulation) specs() []droneSpec {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	specs := make([]droneSpec, 0, len(s.drones))
+	for _, d := range s.drones {
+		if d.State != droneFailed {
+			specs = append(specs, d.spec)
+		}
+	}
+	return specs
+}
+
+// SpawnDrone adds the drone model to the world and connects it to PX4 at
+// mavlinkIP. The ports left zero in spec are allocated from the port pool.
+// The device id and the ports are reserved while the drone is spawned, a
+// failed drone frees its ports and can be spawned again. The drone is
+// returned with its ports also on error.
+func (s *Simulation) SpawnDrone(spec droneSpec, mavlinkIP string) (Drone, error) {
+	if !deviceIDPattern.MatchString(spec.DeviceID) {
+		return Drone{}, errInvalidDeviceID
+	}
+	s.lock.Lock()
+	if d, ok := s.drones[spec.DeviceID]; ok && d.State != droneFailed {
+		s.lock.Unlock()
+		return Drone{}, errDroneExists
+	}
+	err := s.ports.Reserve(&spec)
+	if err != nil {
+		s.lock.Unlock()
+		return Drone{}, err
+	}
+	d := &Drone{
+		DeviceID:       spec.DeviceID,
+		Location:       spec.DroneLocation,
+		State:          droneSpawning,
+		MAVLinkUDPPort: spec.MAVLinkUDPPort,
+		MAVLinkTCPPort: spec.MAVLinkTCPPort,
+		VideoUDPPort:   spec.VideoUDPPort,
+		spec:           spec,
+	}
+	s.drones[spec.DeviceID] = d
+	s.lock.Unlock()
+
+	// add drone model and connect it to the mavlink
+	err = s.runner.Run(fmt.Sprintf("drone (%s): ", spec.DeviceID), spawnTimeout, "bash", "/gzserver-api/scripts/spawn-drone.sh",
+		mavlinkIP,
+		fmt.Sprint(spec.MAVLinkUDPPort),
+		fmt.Sprint(spec.MAVLinkTCPPort),
+		fmt.Sprint(spec.VideoUDPPort),
+		spec.DeviceID,
+		fmt.Sprintf("%f", spec.PosX),
+		fmt.Sprintf("%f", spec.PosY),
+		fmt.Sprintf("%f", spec.PosZ),
+		fmt.Sprintf("%f", spec.Yaw),
+		fmt.Sprintf("%f", spec.Pitch),
+		fmt.Sprintf("%f", spec.Roll))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// the drone is gone if gzserver was started again meanwhile
+	if s.drones[spec.DeviceID] != d {
+		return *d, errors.New("simulation restarted while spawning")
+	}
+	if err != nil {
+		d.State = droneFailed
+		d.Error = err.Error()
+		s.ports.Release(spec)
+		return *d, err
+	}
+	d.State = droneSpawned
+	return *d, nil
+}
+
+// RemoveDrone deletes the drone model from the world and frees the device id
+func (s *Simulation) RemoveDrone(deviceID string) error {
+	s.lock.Lock()
+	d, ok := s.drones[deviceID]
+	if !ok {
+		s.lock.Unlock()
+		return errDroneNotFound
+	}
+	if d.State == droneSpawning || d.State == droneRemoving {
+		s.lock.Unlock()
+		return errDroneBusy
+	}
+	failed := d.State == droneFailed
+	d.State = droneRemoving
+	s.lock.Unlock()
+
+	modelName := droneModelPrefix + deviceID
+	err := s.runner.Run(fmt.Sprintf("drone (%s): ", deviceID), removeTimeout, "gz", "model", "--model-name="+modelName, "--delete")
+	// the model of a failed drone may not exist
+	if err != nil && !failed {
+		s.lock.Lock()
+		if s.drones[deviceID] == d {
+			d.State = droneSpawned
+		}
+		s.lock.Unlock()
+		return err
+	}
+	err = os.Remove(fmt.Sprintf("/tmp/%s.sdf", modelName))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not remove model file of drone %s: %v", deviceID, err)
+	}
+
+	s.lock.Lock()
+	if s.drones[deviceID] == d {
+		delete(s.drones, deviceID)
+		delete(s.poses, deviceID)
+		if !failed {
+			s.ports.Release(d.spec)
+		}
+	}
+	s.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func newTestSimulation(runner commandRunner) *Simulation {
+	return NewSimulation(runner, NewPortPool(
+		portRange{first: 14560, last: 14561},
+		portRange{first: 4560, last: 4561},
+		portRange{first: 5600, last: 5601}))
+}
+
+func dronePorts(d Drone) [3]int32 {
+	return [3]int32{d.MAVLinkUDPPort, d.MAVLinkTCPPort, d.VideoUDPPort}
+}
+
+func TestSimulationSpawnDrone(t *testing.T) {
+	spawnErr := errors.New("exit status 1")
+	tests := []struct {
+		name      string
+		existing  []string
+		spec      droneSpec
+		runErr    error
+		wantErr   error
+		wantState string
+		wantPorts [3]int32
+	}{
+		{
+			name:      "allocated ports",
+			spec:      droneSpec{DeviceID: "d1"},
+			wantState: droneSpawned,
+			wantPorts: [3]int32{14560, 4560, 5600},
+		},
+		{
+			name:      "given ports",
+			spec:      droneSpec{DeviceID: "d1", MAVLinkUDPPort: 14600, MAVLinkTCPPort: 4600, VideoUDPPort: 5700},
+			wantState: droneSpawned,
+			wantPorts: [3]int32{14600, 4600, 5700},
+		},
+		{
+			name:      "ports of existing drone",
+			existing:  []string{"d0"},
+			spec:      droneSpec{DeviceID: "d1"},
+			wantState: droneSpawned,
+			wantPorts: [3]int32{14561, 4561, 5601},
+		},
+		{
+			name:     "device id in use",
+			existing: []string{"d1"},
+			spec:     droneSpec{DeviceID: "d1"},
+			wantErr:  errDroneExists,
+		},
+		{
+			name:    "invalid device id",
+			spec:    droneSpec{DeviceID: "../d1"},
+			wantErr: errInvalidDeviceID,
+		},
+		{
+			name:     "port in use",
+			existing: []string{"d0"},
+			spec:     droneSpec{DeviceID: "d1", MAVLinkUDPPort: 14560},
+			wantErr:  errPortInUse,
+		},
+		{
+			name:     "ports exhausted",
+			existing: []string{"d0", "d1"},
+			spec:     droneSpec{DeviceID: "d2"},
+			wantErr:  errPortsExhausted,
+		},
+		{
+			name:      "spawn fails",
+			spec:      droneSpec{DeviceID: "d1"},
+			runErr:    spawnErr,
+			wantErr:   spawnErr,
+			wantState: droneFailed,
+			wantPorts: [3]int32{14560, 4560, 5600},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := newFakeRunner()
+			s := newTestSimulation(runner)
+			for _, deviceID := range test.existing {
+				_, err := s.SpawnDrone(droneSpec{DeviceID: deviceID}, "10.0.0.1")
+				if err != nil {
+					t.Fatalf("SpawnDrone %s: %v", deviceID, err)
+				}
+			}
+			runner.runErrs["bash"] = test.runErr
+
+			d, err := s.SpawnDrone(test.spec, "10.0.0.1")
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("SpawnDrone = %v, want %v", err, test.wantErr)
+			}
+			if d.State != test.wantState {
+				t.Errorf("state = %s, want %s", d.State, test.wantState)
+			}
+			if dronePorts(d) != test.wantPorts {
+				t.Errorf("ports = %v, want %v", dronePorts(d), test.wantPorts)
+			}
+			// the ports of a failed drone are free
+			if test.wantState == droneFailed {
+				for _, port := range test.wantPorts {
+					if deviceID, ok := s.ports.used[port]; ok {
+						t.Errorf("port %d is used by %s", port, deviceID)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSimulationSpawnCommand(t *testing.T) {
+	runner := newFakeRunner()
+	s := newTestSimulation(runner)
+	spec := droneSpec{DeviceID: "d1", PosX: 1, PosY: 2, PosZ: 0.5, Yaw: 1.5}
+	_, err := s.SpawnDrone(spec, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("SpawnDrone: %v", err)
+	}
+
+	want := "bash /gzserver-api/scripts/spawn-drone.sh 10.0.0.1 14560 4560 5600 d1 1.000000 2.000000 0.500000 1.500000 0.000000 0.000000"
+	if calls := runner.Calls(); len(calls) != 1 || calls[0] != want {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+}
+
+func TestSimulationRespawnFailedDrone(t *testing.T) {
+	runner := newFakeRunner()
+	s := newTestSimulation(runner)
+	runner.runErrs["bash"] = errors.New("exit status 1")
+	_, err := s.SpawnDrone(droneSpec{DeviceID: "d1"}, "10.0.0.1")
+	if err == nil {
+		t.Fatal("SpawnDrone succeeded")
+	}
+
+	delete(runner.runErrs, "bash")
+	d, err := s.SpawnDrone(droneSpec{DeviceID: "d1"}, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("SpawnDrone again: %v", err)
+	}
+	if d.State != droneSpawned || dronePorts(d) != [3]int32{14560, 4560, 5600} {
+		t.Errorf("drone = %+v, want spawned with the first ports", d)
+	}
+	if drones := s.Drones(); len(drones) != 1 {
+		t.Errorf("%d drones, want 1", len(drones))
+	}
+}
+
+func TestSimulationRemoveDrone(t *testing.T) {
+	removeErr := errors.New("exit status 255")
+	tests := []struct {
+		name      string
+		failed    bool
+		state     string
+		deviceID  string
+		runErr    error
+		wantErr   error
+		wantState string
+	}{
+		{
+			name:     "spawned",
+			deviceID: "d1",
+		},
+		{
+			name:      "not found",
+			deviceID:  "d2",
+			wantErr:   errDroneNotFound,
+			wantState: droneSpawned,
+		},
+		{
+			name:      "spawning",
+			state:     droneSpawning,
+			deviceID:  "d1",
+			wantErr:   errDroneBusy,
+			wantState: droneSpawning,
+		},
+		{
+			name:      "removing",
+			state:     droneRemoving,
+			deviceID:  "d1",
+			wantErr:   errDroneBusy,
+			wantState: droneRemoving,
+		},
+		{
+			name:      "delete fails",
+			deviceID:  "d1",
+			runErr:    removeErr,
+			wantErr:   removeErr,
+			wantState: droneSpawned,
+		},
+		{
+			name:     "failed drone without model",
+			failed:   true,
+			deviceID: "d1",
+			runErr:   removeErr,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := newFakeRunner()
+			s := newTestSimulation(runner)
+			if test.failed {
+				runner.runErrs["bash"] = errors.New("exit status 1")
+			}
+			s.SpawnDrone(droneSpec{DeviceID: "d1"}, "10.0.0.1")
+			if test.state != "" {
+				s.drones["d1"].State = test.state
+			}
+			runner.runErrs["gz"] = test.runErr
+
+			err := s.RemoveDrone(test.deviceID)
+			if err != test.wantErr {
+				t.Fatalf("RemoveDrone = %v, want %v", err, test.wantErr)
+			}
+			drones := s.Drones()
+			if test.wantState == "" {
+				if test.wantErr == nil && len(drones) != 0 {
+					t.Errorf("drones = %+v, want none", drones)
+				}
+				if len(s.ports.used) != 0 {
+					t.Errorf("ports %v are used", s.ports.used)
+				}
+				return
+			}
+			if len(drones) != 1 || drones[0].State != test.wantState {
+				t.Errorf("drones = %+v, want d1 %s", drones, test.wantState)
+			}
+			if len(s.ports.used) != 3 {
+				t.Errorf("ports %v are used, want the 3 ports of d1", s.ports.used)
+			}
+		})
+	}
+}
+
+func TestSimulationRemoveDroneCommand(t *testing.T) {
+	runner := newFakeRunner()
+	s := newTestSimulation(runner)
+	_, err := s.SpawnDrone(droneSpec{DeviceID: "d1"}, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("SpawnDrone: %v", err)
+	}
+	err = s.RemoveDrone("d1")
+	if err != nil {
+		t.Fatalf("RemoveDrone: %v", err)
+	}
+
+	want := "gz model --model-name=ssrc_fog_x_d1 --delete"
+	if calls := runner.Calls(); len(calls) != 2 || calls[1] != want {
+		t.Errorf("calls = %q, want %q last", calls, want)
+	}
+}
+
+func TestSimulationStartForgetsDrones(t *testing.T) {
+	runner := newFakeRunner()
+	s := newTestSimulation(runner)
+	_, err := s.SpawnDrone(droneSpec{DeviceID: "d1"}, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("SpawnDrone: %v", err)
+	}
+
+	err = s.Start("/worlds/empty.world", false)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer s.Stop()
+	if drones := s.Drones(); len(drones) != 0 {
+		t.Errorf("drones = %+v after start, want none", drones)
+	}
+	if len(s.ports.used) != 0 {
+		t.Errorf("ports %v are used after start", s.ports.used)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// limits of the stream frame interval
+const (
+	defaultStreamInterval = 200 * time.Millisecond
+	minStreamInterval     = 50 * time.Millisecond
+)
+
+type vector3 struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+type quaternion struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+	W float64 `json:"w"`
+}
+
+// dronePose is the pose of a drone model in the world
+type dronePose struct {
+	DeviceID    string     `json:"device_id"`
+	Position    vector3    `json:"position"`
+	Orientation quaternion `json:"orientation"`
+}
+
+// posePattern matches the poses of gazebo.msgs.PosesStamped messages echoed
+// by gz topic -u. The link poses are scoped with :: and not matched.
+var posePattern = regexp.MustCompile(`pose \{ [^{}]*?name: "` + droneModelPrefix + `([^":]+)"[^{}]*position \{([^}]*)\} orientation \{([^}]*)\}`)
+
+// parsePoses returns the poses of the drone models in the message
+func parsePoses(line string) []dronePose {
+	// most poses are not of drones
+	if !strings.Contains(line, droneModelPrefix) {
+		return nil
+	}
+	var poses []dronePose
+	for _, m := range posePattern.FindAllStringSubmatch(line, -1) {
+		poses = append(poses, dronePose{
+			DeviceID: m[1],
+			Position: vector3{
+				X: parseMsgFloat(m[2], "x"),
+				Y: parseMsgFloat(m[2], "y"),
+				Z: parseMsgFloat(m[2], "z"),
+			},
+			Orientation: quaternion{
+				X: parseMsgFloat(m[3], "x"),
+				Y: parseMsgFloat(m[3], "y"),
+				Z: parseMsgFloat(m[3], "z"),
+				W: parseMsgFloat(m[3], "w"),
+			},
+		})
+	}
+	return poses
+}
+
+// parseMsgFloat returns the value of the field in the message fields,
+// zero if it is missing
+func parseMsgFloat(fields string, name string) float64 {
+	parts := strings.Fields(fields)
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == name+":" {
+			f, _ := strconv.ParseFloat(parts[i+1], 64)
+			return f
+		}
+	}
+	return 0
+}
+
+// poseHandler keeps the latest poses of the drone models. Gazebo publishes
+// only the poses that have changed.
+func (s *Simulation) poseHandler(done <-chan struct{}) func(line string) {
+	return func(line string) {
+		poses := parsePoses(line)
+		if len(poses) == 0 {
+			return
+		}
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.statsDone != done {
+			return
+		}
+		for _, pose := range poses {
+			s.poses[pose.DeviceID] = pose
+		}
+	}
+}
+
+// streamFrame is sent to the /simulation/stream clients
+type streamFrame struct {
+	State          string      `json:"state"`
+	Paused         *bool       `json:"paused,omitempty"`
+	SimTime        *float64    `json:"sim_time,omitempty"`
+	RealTimeFactor *float64    `json:"real_time_factor,omitempty"`
+	Poses          []dronePose `json:"poses"`
+}
+
+// Frame returns the simulation clock and the poses of the spawned drones
+// sorted by device id. Only the drones in deviceIDs are included unless it
+// is empty.
+func (s *Simulation) Frame(deviceIDs map[string]bool) streamFrame {
+	status := s.Status()
+	frame := streamFrame{
+		State:          status.State,
+		Paused:         status.Paused,
+		SimTime:        status.SimTime,
+		RealTimeFactor: status.RealTimeFactor,
+		Poses:          []dronePose{},
+	}
+	if status.State != processRunning {
+		return frame
+	}
+
+	s.lock.Lock()
+	for id, pose := range s.poses {
+		if d, ok := s.drones[id]; !ok || d.State != droneSpawned {
+			continue
+		}
+		if len(deviceIDs) > 0 && !deviceIDs[id] {
+			continue
+		}
+		frame.Poses = append(frame.Poses, pose)
+	}
+	s.lock.Unlock()
+
+	sort.Slice(frame.Poses, func(i, j int) bool {
+		return frame.Poses[i].DeviceID < frame.Poses[j].DeviceID
+	})
+	return frame
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePoses(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []dronePose
+	}{
+		{
+			name: "drones",
+			line: `time { sec: 12 nsec: 344000000 } pose { name: "ground_plane" id: 8 position { x: 0 y: 0 z: 0 } orientation { x: 0 y: 0 z: 0 w: 1 } } ` +
+				`pose { name: "ssrc_fog_x_d1" id: 12 position { x: 1.5 y: -2.25 z: 0.1941 } orientation { x: 0.0012 y: -0.0031 z: 0.7071 w: 0.7071 } } ` +
+				`pose { name: "ssrc_fog_x_d2" id: 40 position { x: 10 y: 0 z: 0.19 } orientation { x: 0 y: 0 z: 0 w: 1 } }`,
+			want: []dronePose{
+				{DeviceID: "d1", Position: vector3{X: 1.5, Y: -2.25, Z: 0.1941}, Orientation: quaternion{X: 0.0012, Y: -0.0031, Z: 0.7071, W: 0.7071}},
+				{DeviceID: "d2", Position: vector3{X: 10, Z: 0.19}, Orientation: quaternion{W: 1}},
+			},
+		},
+		{
+			// the model pose is published with the poses of its links
+			name: "link poses",
+			line: `time { sec: 12 nsec: 348000000 } pose { name: "ssrc_fog_x_d1" id: 12 position { x: 1 y: 2 z: 3 } orientation { x: 0 y: 0 z: 0 w: 1 } } ` +
+				`pose { name: "ssrc_fog_x_d1::base_link" id: 13 position { x: 0 y: 0 z: 0 } orientation { x: 0 y: 0 z: 0 w: 1 } } ` +
+				`pose { name: "ssrc_fog_x_d1::rotor_0" id: 14 position { x: 0.13 y: -0.22 z: 0.023 } orientation { x: 0 y: 0 z: 0.5 w: 0.86 } }`,
+			want: []dronePose{
+				{DeviceID: "d1", Position: vector3{X: 1, Y: 2, Z: 3}, Orientation: quaternion{W: 1}},
+			},
+		},
+		{
+			name: "only link poses",
+			line: `time { sec: 12 nsec: 352000000 } pose { name: "ssrc_fog_x_d1::rotor_1" id: 15 position { x: -0.13 y: 0.2 z: 0.023 } orientation { x: 0 y: 0 z: 0.9 w: 0.43 } }`,
+		},
+		{
+			name: "omitted zero fields",
+			line: `time { sec: 1 } pose { name: "ssrc_fog_x_d1" position { x: 4 } orientation { w: 1 } } pose { name: "ssrc_fog_x_d2" position { } orientation { } }`,
+			want: []dronePose{
+				{DeviceID: "d1", Position: vector3{X: 4}, Orientation: quaternion{W: 1}},
+				{DeviceID: "d2"},
+			},
+		},
+		{
+			name: "exponent",
+			line: `pose { name: "ssrc_fog_x_d1" id: 12 position { x: 1e-05 y: -3.5e-06 z: 0.19 } orientation { x: 0 y: 0 z: 0 w: 1 } }`,
+			want: []dronePose{
+				{DeviceID: "d1", Position: vector3{X: 1e-05, Y: -3.5e-06, Z: 0.19}, Orientation: quaternion{W: 1}},
+			},
+		},
+		{
+			name: "no drones",
+			line: `time { sec: 12 nsec: 344000000 } pose { name: "box" id: 9 position { x: 1 y: 1 z: 0.5 } orientation { x: 0 y: 0 z: 0 w: 1 } }`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parsePoses(test.line)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parsePoses = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFrame(t *testing.T) {
+	s := newTestSimulation(newFakeRunner())
+	for id, state := range map[string]string{"a": droneSpawned, "b": droneSpawned, "c": droneFailed, "d": droneSpawning, "e": droneRemoving} {
+		s.drones[id] = &Drone{State: state}
+		s.poses[id] = dronePose{DeviceID: id}
+	}
+	s.poses["x"] = dronePose{DeviceID: "x"}
+
+	if frame := s.Frame(nil); frame.State != processStopped || len(frame.Poses) != 0 {
+		t.Errorf("frame of stopped simulation = %+v", frame)
+	}
+
+	s.gzserver.status = processStatus{State: processRunning}
+	tests := []struct {
+		deviceIDs map[string]bool
+		want      []string
+	}{
+		{nil, []string{"a", "b"}},
+		{map[string]bool{"b": true, "c": true, "x": true}, []string{"b"}},
+	}
+	for _, test := range tests {
+		frame := s.Frame(test.deviceIDs)
+		var got []string
+		for _, pose := range frame.Poses {
+			got = append(got, pose.DeviceID)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("poses of %v = %v, want %v", test.deviceIDs, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// process states of gzserver
+const (
+	processStarting = "starting"
+	processRunning  = "running"
+	processExited   = "exited"
+	processCrashed  = "crashed"
+	processStopped  = "stopped"
+)
+
+// restartDelay is the wait before a crashed gzserver is started again
+const restartDelay = 2 * time.Second
+
+// gazeboMaster is the address of the Gazebo master started by gzserver
+const gazeboMaster = "localhost:11345"
+
+var errAlreadyRunning = errors.New("simulation already running")
+var errNotRunning = errors.New("simulation not running")
+var errWorldInUse = errors.New("world is used by the simulation")
+
+// processStatus is the state of the gzserver process
+type processStatus struct {
+	State       string     `json:"state"`
+	WorldFile   string     `json:"world_file,omitempty"`
+	PID         int        `json:"pid,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	ExitedAt    *time.Time `json:"exited_at,omitempty"`
+	ExitCode    *int       `json:"exit_code,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	AutoRestart bool       `json:"auto_restart"`
+	Restarts    int        `json:"restarts"`
+}
+
+// supervisor runs gzserver and follows its process. A crashed gzserver is
+// started again if auto restart is set.
+type supervisor struct {
+	runner commandRunner
+
+	lock   sync.Mutex
+	proc   process
+	status processStatus
+	// ready is closed when the current process has loaded the world
+	ready chan struct{}
+	// done is closed when the current process has exited
+	done chan struct{}
+	// tail of the output of the current process
+	tail *logTail
+	// stopping is set while the process is stopped by Stop
+	stopping bool
+	// onStart is called when a new gzserver process has been started
+	onStart func()
+	// onReady is called with the name of the loaded Gazebo world when the
+	// process is ready, done is closed when the process exits
+	onReady func(world string, done <-chan struct{})
+}
+
+func NewSupervisor(runner commandRunner) *supervisor {
+	return &supervisor{
+		runner: runner,
+		status: processStatus{State: processStopped},
+	}
+}
+
+// Start launches gzserver with the world file
+func (s *supervisor) Start(worldFile string, autoRestart bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.proc != nil {
+		return errAlreadyRunning
+	}
+	s.status = processStatus{
+		WorldFile:   worldFile,
+		AutoRestart: autoRestart,
+	}
+	return s.start()
+}
+
+// start launches the process, the lock must be held
+func (s *supervisor) start() error {
+	s.status.State = processStarting
+	s.status.PID = 0
+	s.status.StartedAt = nil
+	s.status.ExitedAt = nil
+	s.status.ExitCode = nil
+	s.status.Error = ""
+
+	s.tail = newLogTail(50)
+	proc, err := s.runner.Start("gzserver: ", s.tail, "bash", "-c", fmt.Sprintf("/gzserver-api/scripts/launch-gzserver.sh %s", s.status.WorldFile))
+	if err != nil {
+		now := time.Now().UTC()
+		s.status.State = processCrashed
+		s.status.ExitedAt = &now
+		s.status.Error = err.Error()
+		return err
+	}
+	now := time.Now().UTC()
+	s.proc = proc
+	s.ready = make(chan struct{})
+	s.done = make(chan struct{})
+	s.status.PID = proc.Pid()
+	s.status.StartedAt = &now
+	if s.onStart != nil {
+		s.onStart()
+	}
+	go s.wait(proc, s.done)
+	go s.waitReady(proc, s.ready, s.done)
+	return nil
+}
+
+// waitReady polls gzserver until the world is loaded and marks it running
+func (s *supervisor) waitReady(proc process, ready chan struct{}, done chan struct{}) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		world, ok := s.worldLoaded()
+		if !ok {
+			continue
+		}
+
+		s.lock.Lock()
+		if s.proc == proc && s.status.State == processStarting {
+			s.status.State = processRunning
+			close(ready)
+			log.Printf("gzserver is ready")
+			if s.onReady != nil {
+				s.onReady(world, done)
+			}
+		}
+		s.lock.Unlock()
+		return
+	}
+}
+
+// worldLoaded reports whether the Gazebo master accepts connections and a
+// world publishes its statistics, and returns the name of the world
+func (s *supervisor) worldLoaded() (string, bool) {
+	conn, err := net.DialTimeout("tcp", gazeboMaster, time.Second)
+	if err != nil {
+		return "", false
+	}
+	conn.Close()
+
+	out, err := s.runner.Output(5*time.Second, "gz", "topic", "-l")
+	if err != nil {
+		return "", false
+	}
+	// the statistics are published in /gazebo/<world>/world_stats
+	for _, topic := range strings.Fields(string(out)) {
+		if strings.HasPrefix(topic, "/gazebo/") && strings.HasSuffix(topic, "/world_stats") {
+			return strings.TrimSuffix(strings.TrimPrefix(topic, "/gazebo/"), "/world_stats"), true
+		}
+	}
+	return "", false
+}
+
+// startupError tells why gzserver did not become ready
+type startupError struct {
+	Error   string   `json:"error"`
+	State   string   `json:"state"`
+	LogTail []string `json:"log_tail"`
+	// status code of the HTTP response
+	status int
+}
+
+// WaitReady waits until the started gzserver has loaded the world. gzserver
+// is stopped if it is not ready in timeout.
+func (s *supervisor) WaitReady(timeout time.Duration) *startupError {
+	s.lock.Lock()
+	ready, done, tail := s.ready, s.done, s.tail
+	s.lock.Unlock()
+	if ready == nil {
+		return &startupError{Error: errNotRunning.Error(), State: processStopped, status: http.StatusBadRequest}
+	}
+
+	select {
+	case <-ready:
+		return nil
+	case <-done:
+		status := s.Status()
+		return &startupError{
+			Error:   fmt.Sprintf("gzserver exited during startup: %s", status.Error),
+			State:   status.State,
+			LogTail: tail.Lines(),
+			status:  http.StatusInternalServerError,
+		}
+	case <-time.After(timeout):
+	}
+
+	msg := fmt.Sprintf("gzserver did not load the world in %v", timeout)
+	err := s.Stop()
+	if err != nil {
+		log.Printf("Could not stop gzserver: %v", err)
+	}
+	s.lock.Lock()
+	s.status.Error = msg
+	state := s.status.State
+	s.lock.Unlock()
+	return &startupError{
+		Error:   msg,
+		State:   state,
+		LogTail: tail.Lines(),
+		status:  http.StatusGatewayTimeout,
+	}
+}
+
+func (s *supervisor) wait(proc process, done chan struct{}) {
+	code, err := proc.Wait()
+	// the launch script leaves Xvfb running in the process group
+	proc.Kill()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer close(done)
+
+	now := time.Now().UTC()
+	s.proc = nil
+	s.status.ExitedAt = &now
+	s.status.ExitCode = &code
+	switch {
+	case s.stopping:
+		s.status.State = processStopped
+		s.stopping = false
+		return
+	case err == nil:
+		s.status.State = processExited
+		log.Printf("gzserver exited")
+		return
+	}
+	s.status.State = processCrashed
+	s.status.Error = err.Error()
+	log.Printf("gzserver crashed: %v", err)
+
+	if s.status.AutoRestart {
+		time.AfterFunc(restartDelay, s.restart)
+	}
+}
+
+// restart starts the crashed gzserver again unless it was started or
+// stopped meanwhile
+func (s *supervisor) restart() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.proc != nil || s.status.State != processCrashed || !s.status.AutoRestart {
+		return
+	}
+	s.status.Restarts++
+	log.Printf("Restarting gzserver, restart %d", s.status.Restarts)
+	err := s.start()
+	if err != nil {
+		log.Printf("Could not restart gzserver: %v", err)
+	}
+}
+
+// Stop kills gzserver and waits for it to exit
+func (s *supervisor) Stop() error {
+	s.lock.Lock()
+	if s.proc == nil {
+		// a crashed process is not restarted after stop
+		s.status.AutoRestart = false
+		s.lock.Unlock()
+		return errNotRunning
+	}
+	s.stopping = true
+	s.status.AutoRestart = false
+	proc := s.proc
+	done := s.done
+	s.lock.Unlock()
+
+	proc.Kill()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(10 * time.Second):
+		return errors.New("gzserver did not exit")
+	}
+}
+
+// RemoveWorld calls remove unless the world file is used by the starting or
+// running gzserver, or by a crashed one that is restarted. gzserver is not
+// started before remove returns.
+func (s *supervisor) RemoveWorld(worldFile string, remove func() error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	restarting := s.status.State == processCrashed && s.status.AutoRestart
+	if (s.proc != nil || restarting) && s.status.WorldFile == worldFile {
+		return errWorldInUse
+	}
+	return remove()
+}
+
+// Running reports whether gzserver is running
+func (s *supervisor) Running() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.proc != nil && s.status.State == processRunning
+}
+
+// Status returns the state of the gzserver process
+func (s *supervisor) Status() processStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.status
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// waitState waits until the state of gzserver is state
+func waitState(t *testing.T, s *supervisor, state string) processStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := s.Status()
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state is %s, want %s", status.State, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSupervisorStart(t *testing.T) {
+	runner := newFakeRunner()
+	s := NewSupervisor(runner)
+	started := 0
+	s.onStart = func() { started++ }
+
+	err := s.Start("/worlds/empty.world", false)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	status := s.Status()
+	if status.State != processStarting || status.PID != 100 || status.WorldFile != "/worlds/empty.world" {
+		t.Errorf("status = %+v, want starting empty.world with pid 100", status)
+	}
+	if started != 1 {
+		t.Errorf("onStart called %d times, want 1", started)
+	}
+	want := "bash -c /gzserver-api/scripts/launch-gzserver.sh /worlds/empty.world"
+	if calls := runner.Calls(); len(calls) != 1 || calls[0] != want {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+
+	err = s.Start("/worlds/other.world", false)
+	if err != errAlreadyRunning {
+		t.Errorf("second Start = %v, want %v", err, errAlreadyRunning)
+	}
+	if s.Running() {
+		t.Error("Running before the world is loaded")
+	}
+
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	waitState(t, s, processStopped)
+	if err := s.Stop(); err != errNotRunning {
+		t.Errorf("second Stop = %v, want %v", err, errNotRunning)
+	}
+}
+
+func TestSupervisorStartError(t *testing.T) {
+	runner := newFakeRunner()
+	runner.startErr = errors.New("bash not found")
+	s := NewSupervisor(runner)
+
+	err := s.Start("/worlds/empty.world", true)
+	if err != runner.startErr {
+		t.Fatalf("Start = %v, want %v", err, runner.startErr)
+	}
+	status := s.Status()
+	if status.State != processCrashed || status.Error != "bash not found" || status.ExitedAt == nil {
+		t.Errorf("status = %+v, want crashed with the start error", status)
+	}
+}
+
+func TestSupervisorExit(t *testing.T) {
+	tests := []struct {
+		name      string
+		exit      func(s *supervisor, proc *fakeProcess)
+		wantState string
+		wantCode  int
+		wantError string
+	}{
+		{
+			name:      "exit",
+			exit:      func(s *supervisor, proc *fakeProcess) { proc.exit(0, nil) },
+			wantState: processExited,
+			wantCode:  0,
+		},
+		{
+			name:      "crash",
+			exit:      func(s *supervisor, proc *fakeProcess) { proc.exit(139, errors.New("exit status 139")) },
+			wantState: processCrashed,
+			wantCode:  139,
+			wantError: "exit status 139",
+		},
+		{
+			name:      "stop",
+			exit:      func(s *supervisor, proc *fakeProcess) { s.Stop() },
+			wantState: processStopped,
+			wantCode:  -1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := newFakeRunner()
+			s := NewSupervisor(runner)
+			err := s.Start("/worlds/empty.world", false)
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+
+			test.exit(s, runner.Process(0))
+			status := waitState(t, s, test.wantState)
+			if status.ExitCode == nil || *status.ExitCode != test.wantCode {
+				t.Errorf("exit code = %v, want %d", status.ExitCode, test.wantCode)
+			}
+			if status.Error != test.wantError {
+				t.Errorf("error = %q, want %q", status.Error, test.wantError)
+			}
+			if wait := s.WaitReady(time.Second); wait == nil || wait.State != test.wantState {
+				t.Errorf("WaitReady = %+v, want state %s", wait, test.wantState)
+			}
+		})
+	}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	runner := newFakeRunner()
+	s := NewSupervisor(runner)
+	err := s.Start("/worlds/empty.world", true)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	runner.Process(0).exit(1, errors.New("exit status 1"))
+	waitState(t, s, processCrashed)
+	status := waitState(t, s, processStarting)
+	if status.Restarts != 1 || status.PID != 101 {
+		t.Errorf("status = %+v, want restart 1 with pid 101", status)
+	}
+
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	status = waitState(t, s, processStopped)
+	if status.AutoRestart {
+		t.Error("auto restart is set after stop")
+	}
+}
+
+func TestSupervisorWaitReady(t *testing.T) {
+	s := NewSupervisor(newFakeRunner())
+	if wait := s.WaitReady(time.Second); wait == nil || wait.status != http.StatusBadRequest {
+		t.Errorf("WaitReady before Start = %+v, want status %d", wait, http.StatusBadRequest)
+	}
+
+	// gzserver is stopped if the Gazebo master does not accept connections
+	err := s.Start("/worlds/empty.world", false)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	wait := s.WaitReady(100 * time.Millisecond)
+	if wait == nil || wait.status != http.StatusGatewayTimeout || wait.State != processStopped {
+		t.Errorf("WaitReady = %+v, want status %d in state stopped", wait, http.StatusGatewayTimeout)
+	}
+}
+
+func TestSupervisorReady(t *testing.T) {
+	l, err := net.Listen("tcp", gazeboMaster)
+	if err != nil {
+		t.Skipf("Gazebo master port is in use: %v", err)
+	}
+	defer l.Close()
+
+	runner := newFakeRunner()
+	runner.output = "/gazebo/default/pose/info\n/gazebo/default/world_stats\n"
+	s := NewSupervisor(runner)
+	world := make(chan string, 1)
+	s.onReady = func(name string, done <-chan struct{}) { world <- name }
+
+	err = s.Start("/worlds/empty.world", false)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if wait := s.WaitReady(5 * time.Second); wait != nil {
+		t.Fatalf("WaitReady = %+v", wait)
+	}
+	if !s.Running() {
+		t.Error("not running after WaitReady")
+	}
+	if name := <-world; name != "default" {
+		t.Errorf("onReady world = %s, want default", name)
+	}
+	s.Stop()
+}
+
+func TestSupervisorRemoveWorld(t *testing.T) {
+	tests := []struct {
+		name        string
+		running     bool
+		status      processStatus
+		wantErr     error
+		wantRemoved bool
+	}{
+		{
+			name:        "stopped",
+			status:      processStatus{State: processStopped, WorldFile: "/worlds/a.world"},
+			wantRemoved: true,
+		},
+		{
+			name:    "starting",
+			running: true,
+			status:  processStatus{State: processStarting, WorldFile: "/worlds/a.world"},
+			wantErr: errWorldInUse,
+		},
+		{
+			name:    "running",
+			running: true,
+			status:  processStatus{State: processRunning, WorldFile: "/worlds/a.world"},
+			wantErr: errWorldInUse,
+		},
+		{
+			name:        "running other world",
+			running:     true,
+			status:      processStatus{State: processRunning, WorldFile: "/worlds/b.world"},
+			wantRemoved: true,
+		},
+		{
+			name:    "crashed with auto restart",
+			status:  processStatus{State: processCrashed, WorldFile: "/worlds/a.world", AutoRestart: true},
+			wantErr: errWorldInUse,
+		},
+		{
+			name:        "crashed",
+			status:      processStatus{State: processCrashed, WorldFile: "/worlds/a.world"},
+			wantRemoved: true,
+		},
+		{
+			name:        "exited",
+			status:      processStatus{State: processExited, WorldFile: "/worlds/a.world", AutoRestart: true},
+			wantRemoved: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewSupervisor(newFakeRunner())
+			s.status = test.status
+			if test.running {
+				s.proc = newFakeProcess(100)
+			}
+
+			removed := false
+			err := s.RemoveWorld("/worlds/a.world", func() error {
+				removed = true
+				return nil
+			})
+			if err != test.wantErr {
+				t.Errorf("RemoveWorld = %v, want %v", err, test.wantErr)
+			}
+			if removed != test.wantRemoved {
+				t.Errorf("removed = %v, want %v", removed, test.wantRemoved)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+)
+
+// formation types
+const (
+	formationGrid   = "grid"
+	formationCircle = "circle"
+	formationLine   = "line"
+)
+
+// limits of the swarm requests
+const (
+	maxSwarmSize            = 100
+	defaultSwarmConcurrency = 4
+	maxSwarmConcurrency     = 10
+)
+
+// defaultSpacing is the distance of the formation drones in meters
+const defaultSpacing = 2.0
+
+// minSeparation is the minimum distance of the drones in meters
+const minSeparation = 1.0
+
+type position struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+// formation generates the positions of the swarm drones
+type formation struct {
+	// Type is grid, circle or line
+	Type string `json:"type"`
+	// Count of the drones generated if the swarm has no drones
+	Count   int      `json:"count"`
+	Spacing float64  `json:"spacing"`
+	Origin  position `json:"origin"`
+	// DeviceIDPrefix of the generated drones, the device ids are
+	// <prefix>1, <prefix>2, ...
+	DeviceIDPrefix string `json:"device_id_prefix"`
+}
+
+// swarmSpec is the body of POST /simulation/swarms. DroneLocation and
+// MAVLinkAddress are used for the drones without them.
+type swarmSpec struct {
+	DroneLocation  string      `json:"drone_location"`
+	MAVLinkAddress string      `json:"mavlink_address"`
+	Drones         []droneSpec `json:"drones"`
+	Formation      *formation  `json:"formation"`
+	// Concurrency is the number of drones spawned at a time
+	Concurrency int `json:"concurrency"`
+}
+
+// swarmResult is the outcome of spawning one swarm drone
+type swarmResult struct {
+	droneSpec
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// planSwarm returns the drones of the swarm with their positions. The device
+// ids must not be used by the existing drones. The drones must be apart from
+// each other and from the existing drones, a formation too close to them is
+// moved past them along the x axis. The ports must not collide.
+func planSwarm(swarm swarmSpec, existing []droneSpec) ([]droneSpec, error) {
+	drones := append([]droneSpec(nil), swarm.Drones...)
+	if f := swarm.Formation; f != nil {
+		if len(drones) == 0 {
+			if f.Count <= 0 || f.Count > maxSwarmSize {
+				return nil, fmt.Errorf("formation count must be between 1 and %d", maxSwarmSize)
+			}
+			prefix := f.DeviceIDPrefix
+			if prefix == "" {
+				prefix = "drone-"
+			}
+			drones = make([]droneSpec, f.Count)
+			for i := range drones {
+				drones[i].DeviceID = fmt.Sprintf("%s%d", prefix, i+1)
+			}
+		}
+		positions, err := f.positions(len(drones))
+		if err != nil {
+			return nil, err
+		}
+		for i, p := range positions {
+			drones[i].PosX, drones[i].PosY, drones[i].PosZ = p.X, p.Y, p.Z
+		}
+	}
+	if len(drones) == 0 {
+		return nil, errors.New("swarm has no drones")
+	}
+	if len(drones) > maxSwarmSize {
+		return nil, fmt.Errorf("swarm has more than %d drones", maxSwarmSize)
+	}
+
+	inUse := make(map[string]bool)
+	for _, d := range existing {
+		inUse[d.DeviceID] = true
+	}
+	ids := make(map[string]bool)
+	for i := range drones {
+		d := &drones[i]
+		if d.DeviceID == "" {
+			return nil, fmt.Errorf("drone %d has no device_id", i)
+		}
+		if !deviceIDPattern.MatchString(d.DeviceID) {
+			return nil, fmt.Errorf("drone %d: %w", i, errInvalidDeviceID)
+		}
+		if inUse[d.DeviceID] {
+			return nil, fmt.Errorf("device id %s is already in use", d.DeviceID)
+		}
+		if ids[d.DeviceID] {
+			return nil, fmt.Errorf("device id %s is used more than once", d.DeviceID)
+		}
+		ids[d.DeviceID] = true
+		if d.DroneLocation == "" {
+			d.DroneLocation = swarm.DroneLocation
+		}
+		if d.MAVLinkAddress == "" {
+			d.MAVLinkAddress = swarm.MAVLinkAddress
+		}
+		if d.MAVLinkAddress == "" {
+			return nil, fmt.Errorf("drone %s has no mavlink_address", d.DeviceID)
+		}
+	}
+
+	if swarm.Formation != nil {
+		offsetFormation(drones, existing)
+	}
+	err := checkSeparation(drones, existing)
+	if err != nil {
+		return nil, err
+	}
+	err = checkPorts(drones, existing)
+	if err != nil {
+		return nil, err
+	}
+	return drones, nil
+}
+
+// positions returns n positions in the formation
+func (f *formation) positions(n int) ([]position, error) {
+	spacing := f.Spacing
+	if spacing == 0 {
+		spacing = defaultSpacing
+	}
+	if spacing < minSeparation {
+		return nil, fmt.Errorf("formation spacing must be at least %g meters", minSeparation)
+	}
+
+	positions := make([]position, n)
+	switch f.Type {
+	case formationLine:
+		for i := range positions {
+			positions[i] = position{X: f.Origin.X + float64(i)*spacing, Y: f.Origin.Y}
+		}
+	case formationGrid:
+		cols := int(math.Ceil(math.Sqrt(float64(n))))
+		for i := range positions {
+			positions[i] = position{
+				X: f.Origin.X + float64(i%cols)*spacing,
+				Y: f.Origin.Y + float64(i/cols)*spacing,
+			}
+		}
+	case formationCircle:
+		// radius where the neighbours are spacing apart on the circle
+		radius := 0.0
+		if n > 1 {
+			radius = math.Max(spacing/(2*math.Sin(math.Pi/float64(n))), spacing)
+		}
+		for i := range positions {
+			angle := 2 * math.Pi * float64(i) / float64(n)
+			positions[i] = position{
+				X: f.Origin.X + radius*math.Cos(angle),
+				Y: f.Origin.Y + radius*math.Sin(angle),
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown formation type '%s'", f.Type)
+	}
+	for i := range positions {
+		positions[i].Z = f.Origin.Z
+	}
+	return positions, nil
+}
+
+// offsetFormation moves the drones along the x axis minSeparation past the
+// existing drones if any of them is too close to an existing drone
+func offsetFormation(drones []droneSpec, existing []droneSpec) {
+	if len(existing) == 0 || checkSeparation(drones, existing) == nil {
+		return
+	}
+	minX, maxX := drones[0].PosX, existing[0].PosX
+	for _, d := range drones {
+		minX = math.Min(minX, d.PosX)
+	}
+	for _, d := range existing {
+		maxX = math.Max(maxX, d.PosX)
+	}
+	shift := maxX + minSeparation - minX
+	for i := range drones {
+		drones[i].PosX += shift
+	}
+}
+
+// checkSeparation fails if a drone is closer than minSeparation to another
+func checkSeparation(drones []droneSpec, existing []droneSpec) error {
+	for i, a := range drones {
+		for _, b := range drones[i+1:] {
+			if distance(a, b) < minSeparation {
+				return fmt.Errorf("drones %s and %s are closer than %g meters", a.DeviceID, b.DeviceID, minSeparation)
+			}
+		}
+		for _, b := range existing {
+			if distance(a, b) < minSeparation {
+				return fmt.Errorf("drone %s is closer than %g meters to drone %s", a.DeviceID, minSeparation, b.DeviceID)
+			}
+		}
+	}
+	return nil
+}
+
+func distance(a droneSpec, b droneSpec) float64 {
+	return math.Sqrt(math.Pow(a.PosX-b.PosX, 2) + math.Pow(a.PosY-b.PosY, 2) + math.Pow(a.PosZ-b.PosZ, 2))
+}
+
+// checkPorts fails if the ports given to the drones collide, the ports
+// left zero are allocated when the drones are spawned
+func checkPorts(drones []droneSpec, existing []droneSpec) error {
+	used := make(map[int32]string)
+	for _, d := range existing {
+		for _, port := range []int32{d.MAVLinkUDPPort, d.MAVLinkTCPPort, d.VideoUDPPort} {
+			used[port] = d.DeviceID
+		}
+	}
+	for _, d := range drones {
+		for _, port := range []int32{d.MAVLinkUDPPort, d.MAVLinkTCPPort, d.VideoUDPPort} {
+			if port == 0 {
+				continue
+			}
+			if other, ok := used[port]; ok {
+				return fmt.Errorf("port %d of drone %s is used by drone %s", port, d.DeviceID, other)
+			}
+			used[port] = d.DeviceID
+		}
+	}
+	return nil
+}
+
+// SpawnSwarm spawns the drones, concurrency at a time, and returns the
+// results in the order of the drones
+func (s *Simulation) SpawnSwarm(drones []droneSpec, concurrency int) []swarmResult {
+	// the mavlink addresses are looked up once
+	ips := make(map[string]string)
+	lookupErrs := make(map[string]error)
+	for _, d := range drones {
+		addr := d.MAVLinkAddress
+		if _, ok := ips[addr]; ok {
+			continue
+		}
+		if _, ok := lookupErrs[addr]; ok {
+			continue
+		}
+		addrs, err := net.LookupIP(addr)
+		if err == nil && len(addrs) == 0 {
+			err = errors.New("no addresses")
+		}
+		if err != nil {
+			log.Printf("Could not lookup mavlink IP '%s': %v", addr, err)
+			lookupErrs[addr] = err
+			continue
+		}
+		ips[addr] = addrs[0].String()
+	}
+
+	results := make([]swarmResult, len(drones))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, d := range drones {
+		results[i].droneSpec = d
+		if err, ok := lookupErrs[d.MAVLinkAddress]; ok {
+			results[i].State = droneFailed
+			results[i].Error = fmt.Sprintf("could not lookup mavlink IP: %v", err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *swarmResult) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			drone, err := s.SpawnDrone(result.droneSpec, ips[result.MAVLinkAddress])
+			if drone.DeviceID != "" {
+				result.droneSpec = drone.spec
+			}
+			if err != nil {
+				log.Printf("Spawn of drone %s failed: %v", result.DeviceID, err)
+				result.State = droneFailed
+				result.Error = err.Error()
+				return
+			}
+			result.State = droneSpawned
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
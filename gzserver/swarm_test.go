@@ -0,0 +1,239 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestPlanSwarm(t *testing.T) {
+	tests := []struct {
+		name     string
+		swarm    swarmSpec
+		existing []droneSpec
+		// want are the device ids and positions of the planned drones
+		want    []droneSpec
+		wantErr string
+	}{
+		{
+			name: "drones",
+			swarm: swarmSpec{
+				DroneLocation:  "local",
+				MAVLinkAddress: "px4",
+				Drones: []droneSpec{
+					{DeviceID: "a", PosX: 0},
+					{DeviceID: "b", PosX: 5, MAVLinkAddress: "other", DroneLocation: "remote"},
+				},
+			},
+			want: []droneSpec{
+				{DeviceID: "a", DroneLocation: "local", MAVLinkAddress: "px4"},
+				{DeviceID: "b", DroneLocation: "remote", MAVLinkAddress: "other", PosX: 5},
+			},
+		},
+		{
+			name: "line",
+			swarm: swarmSpec{
+				MAVLinkAddress: "px4",
+				Formation:      &formation{Type: formationLine, Count: 3, Origin: position{X: 1, Y: 2, Z: 3}},
+			},
+			want: []droneSpec{
+				{DeviceID: "drone-1", MAVLinkAddress: "px4", PosX: 1, PosY: 2, PosZ: 3},
+				{DeviceID: "drone-2", MAVLinkAddress: "px4", PosX: 3, PosY: 2, PosZ: 3},
+				{DeviceID: "drone-3", MAVLinkAddress: "px4", PosX: 5, PosY: 2, PosZ: 3},
+			},
+		},
+		{
+			name: "grid",
+			swarm: swarmSpec{
+				MAVLinkAddress: "px4",
+				Formation:      &formation{Type: formationGrid, Count: 3, Spacing: 4, DeviceIDPrefix: "g"},
+			},
+			want: []droneSpec{
+				{DeviceID: "g1", MAVLinkAddress: "px4"},
+				{DeviceID: "g2", MAVLinkAddress: "px4", PosX: 4},
+				{DeviceID: "g3", MAVLinkAddress: "px4", PosY: 4},
+			},
+		},
+		{
+			name: "circle",
+			swarm: swarmSpec{
+				MAVLinkAddress: "px4",
+				Formation:      &formation{Type: formationCircle, Count: 4},
+			},
+			want: []droneSpec{
+				{DeviceID: "drone-1", MAVLinkAddress: "px4", PosX: 2},
+				{DeviceID: "drone-2", MAVLinkAddress: "px4", PosY: 2},
+				{DeviceID: "drone-3", MAVLinkAddress: "px4", PosX: -2},
+				{DeviceID: "drone-4", MAVLinkAddress: "px4", PosY: -2},
+			},
+		},
+		{
+			name: "formation of given drones",
+			swarm: swarmSpec{
+				MAVLinkAddress: "px4",
+				Drones:         []droneSpec{{DeviceID: "a"}, {DeviceID: "b"}},
+				Formation:      &formation{Type: formationLine, Count: 5},
+			},
+			want: []droneSpec{
+				{DeviceID: "a", MAVLinkAddress: "px4"},
+				{DeviceID: "b", MAVLinkAddress: "px4", PosX: 2},
+			},
+		},
+		{
+			name: "formation moved past existing",
+			swarm: swarmSpec{
+				MAVLinkAddress: "px4",
+				Formation:      &formation{Type: formationLine, Count: 2},
+			},
+			existing: []droneSpec{{DeviceID: "x", PosX: 2.5}, {DeviceID: "y", PosX: -5, PosY: 1}},
+			want: []droneSpec{
+				{DeviceID: "drone-1", MAVLinkAddress: "px4", PosX: 3.5},
+				{DeviceID: "drone-2", MAVLinkAddress: "px4", PosX: 5.5},
+			},
+		},
+		{
+			name: "formation apart from existing",
+			swarm: swarmSpec{
+				MAVLinkAddress: "px4",
+				Formation:      &formation{Type: formationLine, Count: 2},
+			},
+			existing: []droneSpec{{DeviceID: "x", PosY: 5}},
+			want: []droneSpec{
+				{DeviceID: "drone-1", MAVLinkAddress: "px4"},
+				{DeviceID: "drone-2", MAVLinkAddress: "px4", PosX: 2},
+			},
+		},
+		{
+			name:    "no drones",
+			swarm:   swarmSpec{MAVLinkAddress: "px4"},
+			wantErr: "swarm has no drones",
+		},
+		{
+			name:    "formation count",
+			swarm:   swarmSpec{MAVLinkAddress: "px4", Formation: &formation{Type: formationLine, Count: maxSwarmSize + 1}},
+			wantErr: "formation count must be between",
+		},
+		{
+			name:    "formation type",
+			swarm:   swarmSpec{MAVLinkAddress: "px4", Formation: &formation{Type: "star", Count: 2}},
+			wantErr: "unknown formation type",
+		},
+		{
+			name:    "formation spacing",
+			swarm:   swarmSpec{MAVLinkAddress: "px4", Formation: &formation{Type: formationLine, Count: 2, Spacing: 0.5}},
+			wantErr: "formation spacing must be at least",
+		},
+		{
+			name:    "no device id",
+			swarm:   swarmSpec{MAVLinkAddress: "px4", Drones: []droneSpec{{PosX: 1}}},
+			wantErr: "has no device_id",
+		},
+		{
+			name:    "invalid device id",
+			swarm:   swarmSpec{MAVLinkAddress: "px4", Drones: []droneSpec{{DeviceID: "a/.."}}},
+			wantErr: errInvalidDeviceID.Error(),
+		},
+		{
+			name:    "invalid device id prefix",
+			swarm:   swarmSpec{MAVLinkAddress: "px4", Formation: &formation{Type: formationLine, Count: 2, DeviceIDPrefix: "../"}},
+			wantErr: errInvalidDeviceID.Error(),
+		},
+		{
+			name: "duplicate device id",
+			swarm: swarmSpec{
+				MAVLinkAddress: "px4",
+				Drones:         []droneSpec{{DeviceID: "a"}, {DeviceID: "a", PosX: 5}},
+			},
+			wantErr: "device id a is used more than once",
+		},
+		{
+			name:     "device id of existing",
+			swarm:    swarmSpec{MAVLinkAddress: "px4", Formation: &formation{Type: formationLine, Count: 2}},
+			existing: []droneSpec{{DeviceID: "drone-2", PosX: 50}},
+			wantErr:  "device id drone-2 is already in use",
+		},
+		{
+			name:    "no mavlink address",
+			swarm:   swarmSpec{Drones: []droneSpec{{DeviceID: "a"}}},
+			wantErr: "drone a has no mavlink_address",
+		},
+		{
+			name: "too close",
+			swarm: swarmSpec{
+				MAVLinkAddress: "px4",
+				Drones:         []droneSpec{{DeviceID: "a"}, {DeviceID: "b", PosX: 0.5}},
+			},
+			wantErr: "drones a and b are closer than",
+		},
+		{
+			name:     "too close to existing",
+			swarm:    swarmSpec{MAVLinkAddress: "px4", Drones: []droneSpec{{DeviceID: "a", PosZ: 0.5}}},
+			existing: []droneSpec{{DeviceID: "x"}},
+			wantErr:  "drone a is closer than 1 meters to drone x",
+		},
+		{
+			name: "port collision",
+			swarm: swarmSpec{
+				MAVLinkAddress: "px4",
+				Drones: []droneSpec{
+					{DeviceID: "a", MAVLinkUDPPort: 14560},
+					{DeviceID: "b", PosX: 5, VideoUDPPort: 14560},
+				},
+			},
+			wantErr: "port 14560 of drone b is used by drone a",
+		},
+		{
+			name:     "port of existing drone",
+			swarm:    swarmSpec{MAVLinkAddress: "px4", Drones: []droneSpec{{DeviceID: "a", MAVLinkTCPPort: 4560}}},
+			existing: []droneSpec{{DeviceID: "x", PosX: 10, MAVLinkUDPPort: 14560, MAVLinkTCPPort: 4560, VideoUDPPort: 5600}},
+			wantErr:  "port 4560 of drone a is used by drone x",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			drones, err := planSwarm(test.swarm, test.existing)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("planSwarm = %v, want error '%s'", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("planSwarm: %v", err)
+			}
+			if len(drones) != len(test.want) {
+				t.Fatalf("%d drones, want %d", len(drones), len(test.want))
+			}
+			for i, d := range drones {
+				want := test.want[i]
+				if d.DeviceID != want.DeviceID || d.DroneLocation != want.DroneLocation || d.MAVLinkAddress != want.MAVLinkAddress {
+					t.Errorf("drone %d = %+v, want %+v", i, d, want)
+				}
+				if distance(d, want) > 1e-9 {
+					t.Errorf("drone %s at (%g, %g, %g), want (%g, %g, %g)", d.DeviceID, d.PosX, d.PosY, d.PosZ, want.PosX, want.PosY, want.PosZ)
+				}
+			}
+		})
+	}
+}
+
+func TestFormationSeparation(t *testing.T) {
+	for _, typ := range []string{formationGrid, formationCircle, formationLine} {
+		for _, n := range []int{1, 2, 3, 7, maxSwarmSize} {
+			f := formation{Type: typ, Spacing: minSeparation}
+			positions, err := f.positions(n)
+			if err != nil {
+				t.Fatalf("%s of %d: %v", typ, n, err)
+			}
+			for i, a := range positions {
+				for _, b := range positions[i+1:] {
+					d := math.Hypot(a.X-b.X, a.Y-b.Y)
+					// the positions on the circle are not exact
+					if d < minSeparation-1e-9 {
+						t.Errorf("%s of %d: positions %v and %v are %g apart", typ, n, a, b, d)
+					}
+				}
+			}
+		}
+	}
+}
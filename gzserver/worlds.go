@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// maxWorldSize is the maximum size of an uploaded world file
+const maxWorldSize = 10 << 20
+
+var errInvalidWorldName = errors.New("invalid world name")
+var errWorldNotFound = errors.New("world not found")
+var errWorldExists = errors.New("world already exists")
+
+// worldNamePattern matches the file names of the worlds, the names can not
+// refer outside of the worlds directory
+var worldNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*\.(world|sdf)$`)
+
+// sdfFile is the part of an SDF world file the API reads
+type sdfFile struct {
+	XMLName xml.Name   `xml:"sdf"`
+	Version string     `xml:"version,attr"`
+	Worlds  []sdfWorld `xml:"world"`
+}
+
+type sdfWorld struct {
+	Name   string `xml:"name,attr"`
+	Models []struct {
+		Name string `xml:"name,attr"`
+	} `xml:"model"`
+	Includes []struct {
+		URI  string `xml:"uri"`
+		Name string `xml:"name"`
+	} `xml:"include"`
+	SphericalCoordinates *sphericalCoordinates `xml:"spherical_coordinates"`
+	Physics              []struct {
+		MaxStepSize float64 `xml:"max_step_size"`
+	} `xml:"physics"`
+}
+
+type sphericalCoordinates struct {
+	SurfaceModel string  `xml:"surface_model" json:"surface_model"`
+	LatitudeDeg  float64 `xml:"latitude_deg" json:"latitude_deg"`
+	LongitudeDeg float64 `xml:"longitude_deg" json:"longitude_deg"`
+	Elevation    float64 `xml:"elevation" json:"elevation"`
+	HeadingDeg   float64 `xml:"heading_deg" json:"heading_deg"`
+}
+
+// World is a world file in the worlds directory
+type World struct {
+	File     string    `json:"file"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	// Name of the world in the SDF
+	Name                 string                `json:"name,omitempty"`
+	SDFVersion           string                `json:"sdf_version,omitempty"`
+	Models               []string              `json:"models,omitempty"`
+	SphericalCoordinates *sphericalCoordinates `json:"spherical_coordinates,omitempty"`
+	// MaxStepSize is the physics step size in seconds
+	MaxStepSize float64 `json:"max_step_size,omitempty"`
+	// Error tells why the file could not be read
+	Error string `json:"error,omitempty"`
+}
+
+// worldStore manages the world files of the worlds directory
+type worldStore struct {
+	dir string
+}
+
+// Resolve returns the path of the world file. The name must be a file name
+// in the directory.
+func (s *worldStore) Resolve(name string) (string, error) {
+	if !worldNamePattern.MatchString(name) {
+		return "", errInvalidWorldName
+	}
+	path := filepath.Join(s.dir, name)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) || (err == nil && !info.Mode().IsRegular()) {
+		return "", errWorldNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// List returns the worlds sorted by file name
+func (s *worldStore) List() ([]World, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	worlds := []World{}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !worldNamePattern.MatchString(info.Name()) {
+			continue
+		}
+		world := World{
+			File:     info.Name(),
+			Size:     info.Size(),
+			Modified: info.ModTime().UTC(),
+		}
+		b, err := ioutil.ReadFile(filepath.Join(s.dir, info.Name()))
+		if err == nil {
+			err = world.parse(b)
+		}
+		if err != nil {
+			world.Error = err.Error()
+		}
+		worlds = append(worlds, world)
+	}
+	sort.Slice(worlds, func(i, j int) bool {
+		return worlds[i].File < worlds[j].File
+	})
+	return worlds, nil
+}
+
+// Add validates the SDF and writes it to the directory
+func (s *worldStore) Add(name string, r io.Reader) (World, error) {
+	if !worldNamePattern.MatchString(name) {
+		return World{}, errInvalidWorldName
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxWorldSize+1))
+	if err != nil {
+		return World{}, err
+	}
+	if len(b) > maxWorldSize {
+		return World{}, invalidWorldError{fmt.Errorf("world is larger than %d bytes", maxWorldSize)}
+	}
+	world := World{File: name, Size: int64(len(b))}
+	err = world.parse(b)
+	if err != nil {
+		return World{}, invalidWorldError{err}
+	}
+
+	path := filepath.Join(s.dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return World{}, errWorldExists
+	}
+	if err != nil {
+		return World{}, err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// partial worlds are not left behind
+		os.Remove(path)
+		return World{}, err
+	}
+	world.Modified = time.Now().UTC()
+	return world, nil
+}
+
+// Delete removes the world file
+func (s *worldStore) Delete(name string) error {
+	path, err := s.Resolve(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// readWorld reads the metadata of the world file at path
+func readWorld(path string) (World, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return World{}, err
+	}
+	world := World{File: filepath.Base(path), Size: int64(len(b))}
+	err = world.parse(b)
+	if err != nil {
+		return World{}, err
+	}
+	return world, nil
+}
+
+// invalidWorldError tells why an uploaded world was rejected
+type invalidWorldError struct {
+	error
+}
+
+// parse reads the metadata of the world from the SDF. The file must have a
+// single named world.
+func (w *World) parse(b []byte) error {
+	var sdf sdfFile
+	err := xml.Unmarshal(b, &sdf)
+	if err != nil {
+		return fmt.Errorf("invalid SDF: %v", err)
+	}
+	if sdf.Version == "" {
+		return errors.New("invalid SDF: sdf element has no version")
+	}
+	if len(sdf.Worlds) != 1 {
+		return fmt.Errorf("invalid SDF: %d worlds, expected 1", len(sdf.Worlds))
+	}
+	world := sdf.Worlds[0]
+	if world.Name == "" {
+		return errors.New("invalid SDF: world has no name")
+	}
+
+	w.Name = world.Name
+	w.SDFVersion = sdf.Version
+	w.SphericalCoordinates = world.SphericalCoordinates
+	if len(world.Physics) > 0 {
+		w.MaxStepSize = world.Physics[0].MaxStepSize
+	}
+	for _, m := range world.Models {
+		w.Models = append(w.Models, m.Name)
+	}
+	for _, include := range world.Includes {
+		if include.Name != "" {
+			w.Models = append(w.Models, include.Name)
+		} else {
+			w.Models = append(w.Models, include.URI)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testWorld = `<?xml version="1.0"?>
+<sdf version="1.6">
+  <world name="default">
+    <physics type="ode">
+      <max_step_size>0.004</max_step_size>
+    </physics>
+    <include>
+      <uri>model://sun</uri>
+    </include>
+    <include>
+      <uri>model://ground_plane</uri>
+      <name>ground</name>
+    </include>
+    <model name="box"></model>
+  </world>
+</sdf>
+`
+
+func newTestWorldStore(t *testing.T) *worldStore {
+	dir, err := ioutil.TempDir("", "worlds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &worldStore{dir: dir}
+}
+
+func TestWorldStoreAdd(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		sdf     string
+		wantErr string
+	}{
+		{name: "world", file: "a.world", sdf: testWorld},
+		{name: "sdf", file: "a_b-1.sdf", sdf: testWorld},
+		{name: "path", file: "../a.world", sdf: testWorld, wantErr: errInvalidWorldName.Error()},
+		{name: "hidden", file: ".a.world", sdf: testWorld, wantErr: errInvalidWorldName.Error()},
+		{name: "extension", file: "a.xml", sdf: testWorld, wantErr: errInvalidWorldName.Error()},
+		{name: "not xml", file: "a.world", sdf: "world", wantErr: "invalid SDF"},
+		{name: "no version", file: "a.world", sdf: `<sdf><world name="a"/></sdf>`, wantErr: "sdf element has no version"},
+		{name: "no world", file: "a.world", sdf: `<sdf version="1.6"></sdf>`, wantErr: "0 worlds, expected 1"},
+		{name: "two worlds", file: "a.world", sdf: `<sdf version="1.6"><world name="a"/><world name="b"/></sdf>`, wantErr: "2 worlds, expected 1"},
+		{name: "no world name", file: "a.world", sdf: `<sdf version="1.6"><world/></sdf>`, wantErr: "world has no name"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newTestWorldStore(t)
+			world, err := store.Add(test.file, strings.NewReader(test.sdf))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Add = %v, want error '%s'", err, test.wantErr)
+				}
+				if infos, _ := ioutil.ReadDir(store.dir); len(infos) != 0 {
+					t.Errorf("%d files written on error", len(infos))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+			if world.File != test.file || world.Name != "default" || world.SDFVersion != "1.6" || world.MaxStepSize != 0.004 {
+				t.Errorf("world = %+v", world)
+			}
+			if models := strings.Join(world.Models, ","); models != "box,model://sun,ground" {
+				t.Errorf("models = %s, want box,model://sun,ground", models)
+			}
+			b, err := ioutil.ReadFile(filepath.Join(store.dir, test.file))
+			if err != nil || string(b) != test.sdf {
+				t.Errorf("world file = %q, %v", b, err)
+			}
+		})
+	}
+}
+
+func TestWorldStoreAddExisting(t *testing.T) {
+	store := newTestWorldStore(t)
+	_, err := store.Add("a.world", strings.NewReader(testWorld))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	_, err = store.Add("a.world", strings.NewReader(testWorld))
+	if err != errWorldExists {
+		t.Errorf("second Add = %v, want %v", err, errWorldExists)
+	}
+}
+
+func TestWorldStoreResolve(t *testing.T) {
+	store := newTestWorldStore(t)
+	err := ioutil.WriteFile(filepath.Join(store.dir, "a.world"), []byte(testWorld), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(store.dir, "dir.world"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr error
+	}{
+		{name: "a.world", want: filepath.Join(store.dir, "a.world")},
+		{name: "b.world", wantErr: errWorldNotFound},
+		{name: "dir.world", wantErr: errWorldNotFound},
+		{name: "../a.world", wantErr: errInvalidWorldName},
+		{name: "a", wantErr: errInvalidWorldName},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := store.Resolve(test.name)
+			if err != test.wantErr || got != test.want {
+				t.Errorf("Resolve = %s, %v, want %s, %v", got, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestWorldStoreList(t *testing.T) {
+	store := newTestWorldStore(t)
+	files := map[string]string{
+		"b.world":   testWorld,
+		"a.sdf":     testWorld,
+		"bad.world": "<sdf>",
+		"notes.txt": "not a world",
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(store.dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	worlds, err := store.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var names []string
+	for _, w := range worlds {
+		names = append(names, w.File)
+	}
+	if got := strings.Join(names, ","); got != "a.sdf,b.world,bad.world" {
+		t.Fatalf("worlds = %s, want a.sdf,b.world,bad.world", got)
+	}
+	if worlds[0].Name != "default" || worlds[0].Error != "" {
+		t.Errorf("world a.sdf = %+v", worlds[0])
+	}
+	if worlds[2].Error == "" {
+		t.Error("invalid world bad.world has no error")
+	}
+}
+
+func TestWorldStoreDelete(t *testing.T) {
+	store := newTestWorldStore(t)
+	_, err := store.Add("a.world", strings.NewReader(testWorld))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	err = store.Delete("a.world")
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(store.dir, "a.world")); !os.IsNotExist(err) {
+		t.Errorf("world file exists after delete: %v", err)
+	}
+	if err := store.Delete("a.world"); err != errWorldNotFound {
+		t.Errorf("second Delete = %v, want %v", err, errWorldNotFound)
+	}
+	if err := store.Delete("../a.world"); err != errInvalidWorldName {
+		t.Errorf("Delete outside = %v, want %v", err, errInvalidWorldName)
+	}
+}
@@ -9,6 +9,7 @@ require (
 	github.com/gosimple/slug v1.9.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/tiiuae/gosshgit v0.0.0-20210315120410-86f6fa64a1dc
+	github.com/xeipuuv/gojsonschema v1.2.0
 	golang.org/x/crypto v0.0.0-20210314154223-e6e6c4f2bb5b
 	google.golang.org/api v0.41.0
 	gopkg.in/yaml.v2 v2.4.0
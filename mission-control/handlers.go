@@ -816,8 +816,33 @@ func isDroneActive(deviceID string) bool {
 	return true
 }
 
+// handleMQTTState follows the connection state published by mqtt-server
+func handleMQTTState(deviceID string, payload []byte) {
+	var state struct {
+		State  string `json:"state"`
+		Reason string `json:"reason"`
+	}
+	err := json.Unmarshal(payload, &state)
+	if err != nil {
+		log.Printf("Could not unmarshal state of %s: %v", deviceID, err)
+		return
+	}
+	switch state.State {
+	case "online":
+		activeDrones[deviceID] = time.Now()
+	case "offline":
+		log.Printf("Drone %s is offline: %s", deviceID, state.Reason)
+		delete(activeDrones, deviceID)
+	}
+}
+
 func handleMQTTEvent(deviceID string, topic string, payload []byte) {
 	activeDrones[deviceID] = time.Now()
+	if errs := validateEvent(topic, payload); len(errs) > 0 {
+		log.Printf("Invalid %s event from %s: %s", topic, deviceID, strings.Join(errs, "; "))
+		go reportInvalidEvent(deviceID, topic, payload, errs)
+		return
+	}
 	switch topic {
 	case "trust":
 		log.Printf("Got a trust-event from %v", deviceID)
@@ -26,6 +26,13 @@ func main() {
 	sshServerAddress = os.Args[1]
 
 	mqttBrokerAddress := os.Args[2]
+	if schemaDir := os.Getenv("MQTT_SCHEMAS"); schemaDir != "" {
+		err := loadEventSchemas(schemaDir)
+		if err != nil {
+			log.Fatalf("Could not load event schemas: %v", err)
+		}
+		log.Printf("Validating events with %d schemas", len(eventSchemas))
+	}
 	if mqttBrokerAddress == "cloud-pull" {
 		log.Println("MQTT: IoT Core pull")
 		mqttPub = NewIoTPublisher()
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 	"strings"
 	"time"
 
@@ -13,10 +14,17 @@ func newMQTTClient(id string, brokerAddress string) mqtt.Client {
 		AddBroker(brokerAddress).
 		SetClientID(id).
 		SetUsername(id).
-		//SetTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}).
-		SetPassword("").
+		SetPassword(os.Getenv("MQTT_PASSWORD")).
 		SetProtocolVersion(4) // Use MQTT 3.1.1
 
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		log.Fatalf("Could not create MQTT TLS config: %v", err)
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
 	client := mqtt.NewClient(opts)
 
 	tok := client.Connect()
@@ -26,7 +34,7 @@ func newMQTTClient(id string, brokerAddress string) mqtt.Client {
 	if !tok.WaitTimeout(time.Second * 5) {
 		log.Fatal("MQTT connection timeout")
 	}
-	err := tok.Error()
+	err = tok.Error()
 	if err != nil {
 		log.Fatalf("Could not connect to MQTT broker: %v", err)
 	}
@@ -42,6 +50,8 @@ func listenMQTTEvents(client mqtt.Client) {
 		topic := strings.TrimPrefix(t, deviceID+"/")
 		if strings.HasPrefix(topic, "events") {
 			handleMQTTEvent(deviceID, strings.TrimPrefix(topic, "events/"), msg.Payload())
+		} else if topic == "state" {
+			handleMQTTState(deviceID, msg.Payload())
 		}
 	})
 
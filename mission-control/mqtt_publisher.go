@@ -24,6 +24,8 @@ const (
 
 type MqttPublisher interface {
 	SendCommand(deviceID string, subfolder string, payload []byte) error
+	// PublishError publishes to the dead-letter topic of the device
+	PublishError(deviceID string, payload []byte) error
 }
 
 type mqttPublisher struct {
@@ -48,6 +50,15 @@ func (pub *mqttPublisher) SendCommand(deviceID string, subfolder string, payload
 	return nil
 }
 
+func (pub *mqttPublisher) PublishError(deviceID string, payload []byte) error {
+	topic := fmt.Sprintf("/devices/%s/errors", deviceID)
+	pubtok := pub.client.Publish(topic, qos, retain, payload)
+	if !pubtok.WaitTimeout(time.Second * 2) {
+		return errors.New("MQTT client timeout")
+	}
+	return pubtok.Error()
+}
+
 func (pub *iotPublisher) SendCommand(deviceID string, subfolder string, payload []byte) error {
 	ctx := context.Background()
 	client, err := cloudiot.NewService(ctx)
@@ -66,3 +77,7 @@ func (pub *iotPublisher) SendCommand(deviceID string, subfolder string, payload
 
 	return err
 }
+
+func (pub *iotPublisher) PublishError(deviceID string, payload []byte) error {
+	return errors.New("IoT Core has no dead-letter topics")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// eventSchemas are the JSON schemas of the device events by event name,
+// the events are not validated if empty
+var eventSchemas = make(map[string]*gojsonschema.Schema)
+
+// loadEventSchemas reads events/<event>.json schemas from the schema
+// directory shared with mqtt-server
+func loadEventSchemas(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "events", "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(abs)))
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		eventSchemas[strings.TrimSuffix(filepath.Base(file), ".json")] = schema
+	}
+	return nil
+}
+
+// validateEvent checks the payload against the schema of the event. The
+// events without a schema are valid.
+func validateEvent(event string, payload []byte) []string {
+	schema, ok := eventSchemas[event]
+	if !ok {
+		return nil
+	}
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(payload))
+	if err != nil {
+		return []string{fmt.Sprintf("invalid JSON: %v", err)}
+	}
+	var errs []string
+	for _, e := range result.Errors() {
+		errs = append(errs, e.String())
+	}
+	return errs
+}
+
+// reportInvalidEvent publishes the rejected event to the dead-letter topic
+// /devices/<device-id>/errors
+func reportInvalidEvent(deviceID string, event string, payload []byte, errs []string) {
+	msg, err := json.Marshal(struct {
+		Topic     string    `json:"topic"`
+		Errors    []string  `json:"errors"`
+		Payload   string    `json:"payload"`
+		Source    string    `json:"source"`
+		Timestamp time.Time `json:"timestamp"`
+	}{
+		Topic:     fmt.Sprintf("/devices/%s/events/%s", deviceID, event),
+		Errors:    errs,
+		Payload:   string(payload),
+		Source:    "mission-control",
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("Could not marshal dead letter: %v", err)
+		return
+	}
+	err = mqttPub.PublishError(deviceID, msg)
+	if err != nil {
+		log.Printf("Could not publish dead letter of %s: %v", deviceID, err)
+	}
+}
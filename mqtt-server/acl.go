@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/VolantMQ/vlapi/vlauth"
+	"gopkg.in/yaml.v2"
+)
+
+// topicRules lists the topic patterns a client may use. Patterns can use
+// MQTT wildcards and {device} which is replaced with the client's device id.
+type topicRules struct {
+	Publish   []string `yaml:"publish"`
+	Subscribe []string `yaml:"subscribe"`
+}
+
+type aclRules struct {
+	// Devices applies to all clients registered in the device registry
+	Devices topicRules `yaml:"devices"`
+	// Services applies to named service clients by client id. A name
+	// ending with * applies to all client ids with the prefix. The service
+	// clients must authenticate with certAuth or serviceAuth, other clients
+	// using the client ids are refused.
+	Services map[string]topicRules `yaml:"services"`
+	// Default applies to all other clients
+	Default topicRules `yaml:"default"`
+}
+
+func LoadACLRules(file string) (*aclRules, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules aclRules
+	err = yaml.UnmarshalStrict(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rules, nil
+}
+
+// service returns the rules of the service client, exact names are
+// preferred over the longest matching prefix
+func (r *aclRules) service(clientID string) (topicRules, bool) {
+	var rules topicRules
+	best := -1
+	for name, rs := range r.Services {
+		if n := matchClientPattern(name, clientID); n > best {
+			rules = rs
+			best = n
+		}
+	}
+	return rules, best >= 0
+}
+
+// matchClientPattern ranks how well the client id matches the name of a
+// client pattern. A name ending with * matches the client ids with the
+// prefix and ranks by the length of the prefix, an exact match ranks above
+// all prefixes. Returns -1 if the client id does not match.
+func matchClientPattern(name string, clientID string) int {
+	if name == clientID {
+		return math.MaxInt32
+	}
+	prefix := strings.TrimSuffix(name, "*")
+	if prefix != name && strings.HasPrefix(clientID, prefix) {
+		return len(prefix)
+	}
+	return -1
+}
+
+// aclAuth checks topic permissions against aclRules. It never authenticates
+// clients, so it is appended to every auth manager after the real providers.
+type aclAuth struct {
+	rules   *aclRules
+	devices *deviceRegistry
+}
+
+// isService reports whether the client id has service rules
+func (a *aclAuth) isService(clientID string) bool {
+	if a.rules == nil || a.devices.Exists(deviceIDFromClientID(clientID)) {
+		return false
+	}
+	_, ok := a.rules.service(clientID)
+	return ok
+}
+
+func (a *aclAuth) Password(clientid, user, pass string) error {
+	return vlauth.StatusDeny
+}
+func (a *aclAuth) ACL(clientId, user, topic string, access vlauth.AccessType) error {
+	if a.rules == nil {
+		return vlauth.StatusAllow
+	}
+
+	deviceID := deviceIDFromClientID(clientId)
+	var rules topicRules
+	if a.devices.Exists(deviceID) {
+		rules = a.rules.Devices
+	} else if r, ok := a.rules.service(clientId); ok && (user == certUser || user == clientId) {
+		rules = r
+	} else {
+		rules = a.rules.Default
+	}
+
+	patterns := rules.Subscribe
+	if access == vlauth.AccessWrite {
+		patterns = rules.Publish
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ReplaceAll(pattern, "{device}", deviceID)
+		if topicFilterCovers(pattern, topic) {
+			return vlauth.StatusAllow
+		}
+	}
+
+	log.Printf("ACL denied %s: clientId: %v topic: %v", access.Type(), clientId, topic)
+	aclDenied.WithLabelValues(access.Type()).Inc()
+	return vlauth.StatusDeny
+}
+func (a *aclAuth) Shutdown() error {
+	return nil
+}
+
+// topicFilterCovers reports whether every topic matched by filter is also
+// matched by pattern. For plain topic names this is normal MQTT matching.
+func topicFilterCovers(pattern string, filter string) bool {
+	p := strings.Split(pattern, "/")
+	f := strings.Split(filter, "/")
+
+	for i, level := range p {
+		if level == "#" {
+			return true
+		}
+		if i >= len(f) {
+			return false
+		}
+		if level == "+" {
+			if f[i] == "#" {
+				return false
+			}
+			continue
+		}
+		if level != f[i] {
+			return false
+		}
+	}
+
+	return len(p) == len(f)
+}
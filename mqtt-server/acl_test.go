@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/VolantMQ/vlapi/vlauth"
+)
+
+func TestTopicFilterCovers(t *testing.T) {
+	tests := []struct {
+		pattern string
+		filter  string
+		want    bool
+	}{
+		{"/devices/d1/events", "/devices/d1/events", true},
+		{"/devices/d1/events", "/devices/d2/events", false},
+		{"/devices/d1/events", "/devices/d1/events/telemetry", false},
+		{"/devices/d1/events/telemetry", "/devices/d1/events", false},
+		{"/devices/+/events", "/devices/d1/events", true},
+		{"/devices/+/events", "/devices/+/events", true},
+		{"/devices/+/events", "/devices/#", false},
+		{"/devices/+/events", "/devices/d1", false},
+		{"/devices/d1/events", "/devices/+/events", false},
+		{"/devices/#", "/devices", true},
+		{"/devices/#", "/devices/d1/events/telemetry", true},
+		{"/devices/#", "/devices/#", true},
+		{"/devices/#", "/devices/+/events", true},
+		{"/devices/d1/#", "/devices/#", false},
+		{"/devices/d1/#", "/devices/+/events", false},
+		{"#", "/devices/d1/events", true},
+		{"#", "#", true},
+		{"+", "/devices", false},
+		{"+/devices", "/devices", true},
+	}
+	for _, test := range tests {
+		got := topicFilterCovers(test.pattern, test.filter)
+		if got != test.want {
+			t.Errorf("topicFilterCovers(%q, %q) = %v, want %v", test.pattern, test.filter, got, test.want)
+		}
+	}
+}
+
+func newTestACL(t *testing.T) *aclAuth {
+	rules, err := LoadACLRules("acl.yaml")
+	if err != nil {
+		t.Fatalf("LoadACLRules: %v", err)
+	}
+	rules.Services["dashboard-*"] = topicRules{Subscribe: []string{"/devices/#"}}
+	devices := NewDeviceRegistry()
+	devices.devices["d1"] = &device{}
+	devices.devices["dashboard-drone"] = &device{}
+	return &aclAuth{rules: rules, devices: devices}
+}
+
+func TestACL(t *testing.T) {
+	const read, write = vlauth.AccessRead, vlauth.AccessWrite
+	tests := []struct {
+		name     string
+		clientID string
+		user     string
+		topic    string
+		access   vlauth.AccessType
+		want     error
+	}{
+		{"device publishes own events", "d1", "", "/devices/d1/events/telemetry", write, vlauth.StatusAllow},
+		{"device publishes events of another", "d1", "", "/devices/d2/events/telemetry", write, vlauth.StatusDeny},
+		{"device subscribes own commands", "d1", "", "/devices/d1/commands/#", read, vlauth.StatusAllow},
+		{"device subscribes all commands", "d1", "", "/devices/+/commands/#", read, vlauth.StatusDeny},
+		{"device publishes commands", "d1", "", "/devices/d1/commands/control", write, vlauth.StatusDeny},
+		{"cloud iot client id", "projects/p/locations/l/registries/r/devices/d1", "", "/devices/d1/events/telemetry", write, vlauth.StatusAllow},
+		{"service publishes commands", "mission-control", certUser, "/devices/d1/commands/control", write, vlauth.StatusAllow},
+		{"service subscribes", "mission-control", certUser, "/devices/#", read, vlauth.StatusAllow},
+		{"service publishes events", "mission-control", certUser, "/devices/d1/events/telemetry", write, vlauth.StatusDeny},
+		{"service without certificate", "mission-control", "", "/devices/d1/commands/control", write, vlauth.StatusDeny},
+		{"service with token", "mission-control", "mission-control", "/devices/#", read, vlauth.StatusAllow},
+		{"service with other user", "mission-control", "video-multiplexer", "/devices/#", read, vlauth.StatusDeny},
+		{"service prefix", "dashboard-1", certUser, "/devices/d1/commands/#", read, vlauth.StatusAllow},
+		{"service prefix without certificate", "dashboard-1", "", "/devices/d1/commands/#", read, vlauth.StatusDeny},
+		{"service prefix with token", "dashboard-1", "dashboard-1", "/devices/d1/commands/#", read, vlauth.StatusAllow},
+		{"device named like a service", "dashboard-drone", "dashboard-drone", "/devices/d1/commands/control", write, vlauth.StatusDeny},
+		{"device named like a service with certificate", "dashboard-drone", certUser, "/devices/d1/commands/control", write, vlauth.StatusDeny},
+		{"default subscribes events", "browser", "", "/devices/+/events/#", read, vlauth.StatusAllow},
+		{"default subscribes commands", "browser", "", "/devices/+/commands/#", read, vlauth.StatusDeny},
+		{"default publishes", "browser", "", "/devices/d1/events/telemetry", write, vlauth.StatusDeny},
+	}
+	a := newTestACL(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := a.ACL(test.clientID, test.user, test.topic, test.access)
+			if got != test.want {
+				t.Errorf("ACL(%s, %s, %s, %s) = %v, want %v", test.clientID, test.user, test.topic, test.access.Type(), got, test.want)
+			}
+		})
+	}
+}
+
+func TestACLWithoutRules(t *testing.T) {
+	a := &aclAuth{devices: NewDeviceRegistry()}
+	if got := a.ACL("any", "", "/devices/d1/commands/control", vlauth.AccessWrite); got != vlauth.StatusAllow {
+		t.Errorf("ACL = %v, want allow", got)
+	}
+	if a.isService("mission-control") {
+		t.Error("isService without rules")
+	}
+}
+
+func TestIsService(t *testing.T) {
+	tests := []struct {
+		clientID string
+		want     bool
+	}{
+		{"mission-control", true},
+		{"mqtt-server-bridge", true},
+		{"dashboard-1", true},
+		{"dashboard-", true},
+		{"mission-control-2", false},
+		{"dashboard-drone", false},
+		{"d1", false},
+		{"browser", false},
+	}
+	a := newTestACL(t)
+	for _, test := range tests {
+		if got := a.isService(test.clientID); got != test.want {
+			t.Errorf("isService(%s) = %v, want %v", test.clientID, got, test.want)
+		}
+	}
+}
+
+func TestMatchClientPattern(t *testing.T) {
+	names := []string{"mission-control", "dashboard-*", "dashboard-admin-*", "*"}
+	tests := []struct {
+		clientID string
+		want     string
+	}{
+		{"mission-control", "mission-control"},
+		{"mission-control-2", "*"},
+		{"dashboard-1", "dashboard-*"},
+		{"dashboard-admin-1", "dashboard-admin-*"},
+		{"dashboard-", "dashboard-*"},
+		{"dashboard", "*"},
+	}
+	for _, test := range tests {
+		got, best := "", -1
+		for _, name := range names {
+			if n := matchClientPattern(name, test.clientID); n > best {
+				got, best = name, n
+			}
+		}
+		if got != test.want {
+			t.Errorf("%s matches %q, want %q", test.clientID, got, test.want)
+		}
+	}
+	if n := matchClientPattern("dashboard-*", "mission-control"); n != -1 {
+		t.Errorf("matchClientPattern of other prefix = %d, want -1", n)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var errClientNotFound = errors.New("client not found")
+
+// admin implements the broker operations of the admin API
+type admin struct {
+	frontends []*frontend
+	// broker listener address for the admin clients
+	broker string
+	// certToken authenticates the admin clients with any client id
+	certToken string
+	// retained removes the deleted retained messages from the persistence,
+	// disabled if nil
+	retained retainedWriter
+}
+
+// Clients returns the connected clients of all listeners
+func (a *admin) Clients() []clientInfo {
+	var clients []clientInfo
+	for _, f := range a.frontends {
+		clients = append(clients, f.Clients()...)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ClientID < clients[j].ClientID
+	})
+	return clients
+}
+
+// Kick disconnects the client
+func (a *admin) Kick(clientID string) error {
+	kicked := false
+	for _, f := range a.frontends {
+		if f.Kick(clientID) {
+			kicked = true
+		}
+	}
+	if !kicked {
+		return errClientNotFound
+	}
+	return nil
+}
+
+// ClearSession removes the session of the client from the broker by
+// connecting with its client id and a clean session. A connected client is
+// disconnected first.
+func (a *admin) ClearSession(clientID string) error {
+	a.Kick(clientID)
+	// the broker refuses the client id while the old session is online
+	deadline := time.Now().Add(5 * time.Second)
+	for a.connected(clientID) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("client %s did not disconnect", clientID)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(a.broker).
+		SetClientID(clientID).
+		SetUsername(certUser).
+		SetPassword(a.certToken).
+		SetProtocolVersion(4). // Use MQTT 3.1.1
+		SetCleanSession(true).
+		SetAutoReconnect(false)
+	client := mqtt.NewClient(opts)
+	tok := client.Connect()
+	if !tok.WaitTimeout(5 * time.Second) {
+		return errors.New("MQTT connection timeout")
+	}
+	if err := tok.Error(); err != nil {
+		return err
+	}
+	client.Disconnect(250)
+	return nil
+}
+
+// DeleteRetained removes the retained message of the topic
+func (a *admin) DeleteRetained(topic string) error {
+	if topic == "" || strings.ContainsAny(topic, "#+") {
+		return fmt.Errorf("invalid topic %q", topic)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(a.broker).
+		SetClientID("mqtt-server-admin").
+		SetUsername(certUser).
+		SetPassword(a.certToken).
+		SetProtocolVersion(4). // Use MQTT 3.1.1
+		SetAutoReconnect(false)
+	client := mqtt.NewClient(opts)
+	tok := client.Connect()
+	if !tok.WaitTimeout(5 * time.Second) {
+		return errors.New("MQTT connection timeout")
+	}
+	if err := tok.Error(); err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+
+	// an empty retained message removes the retained message of the topic
+	tok = client.Publish(topic, 1, true, []byte{})
+	if !tok.WaitTimeout(5 * time.Second) {
+		return errors.New("MQTT publish timeout")
+	}
+	if err := tok.Error(); err != nil {
+		return err
+	}
+	if a.retained != nil {
+		return a.retained.WriteRetained(topic, 1, nil)
+	}
+	return nil
+}
+
+func (a *admin) connected(clientID string) bool {
+	for _, f := range a.frontends {
+		if f.Connected(clientID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// api serves the HTTP API of the device registry and the broker admin
+type api struct {
+	token   string
+	devices *deviceRegistry
+	admin   *admin
+	router  *httprouter.Router
+}
+
+// NewAPI creates the API handler. The requests must have the token as
+// bearer token in the Authorization header.
+func NewAPI(token string, devices *deviceRegistry, admin *admin) *api {
+	a := &api{
+		token:   token,
+		devices: devices,
+		admin:   admin,
+		router:  httprouter.New(),
+	}
+	a.router.HandlerFunc(http.MethodGet, "/devices", a.listDevicesHandler)
+	a.router.HandlerFunc(http.MethodPost, "/devices", a.createDeviceHandler)
+	a.router.HandlerFunc(http.MethodGet, "/devices/:deviceID", a.getDeviceHandler)
+	a.router.HandlerFunc(http.MethodDelete, "/devices/:deviceID", a.deleteDeviceHandler)
+	a.router.HandlerFunc(http.MethodPut, "/devices/:deviceID/key", a.rotateKeyHandler)
+	a.router.HandlerFunc(http.MethodPost, "/devices/:deviceID/disable", a.disableDeviceHandler)
+	a.router.HandlerFunc(http.MethodPost, "/devices/:deviceID/enable", a.enableDeviceHandler)
+	// client ids can contain slashes
+	a.router.HandlerFunc(http.MethodGet, "/clients", a.listClientsHandler)
+	a.router.HandlerFunc(http.MethodDelete, "/clients/*clientID", a.kickClientHandler)
+	a.router.HandlerFunc(http.MethodDelete, "/sessions/*clientID", a.clearSessionHandler)
+	a.router.HandlerFunc(http.MethodDelete, "/retained", a.deleteRetainedHandler)
+	return a
+}
+
+// Handle registers the API routes to mux
+func (a *api) Handle(mux *http.ServeMux) {
+	for _, path := range []string{"/devices", "/devices/", "/clients", "/clients/", "/sessions/", "/retained"} {
+		mux.Handle(path, a)
+	}
+}
+
+func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	header := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	a.router.ServeHTTP(w, r)
+}
+
+func (a *api) listDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.devices.List())
+}
+
+func (a *api) getDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := httprouter.ParamsFromContext(r.Context()).ByName("deviceID")
+	device, ok := a.devices.Get(deviceID)
+	if !ok {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, device)
+}
+
+func (a *api) createDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		DeviceID  string `json:"device_id"`
+		PublicKey string `json:"public_key"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	defer r.Body.Close()
+	if err != nil {
+		log.Printf("Could not decode body: %v", err)
+		http.Error(w, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+
+	err = a.devices.Create(requestBody.DeviceID, []byte(requestBody.PublicKey))
+	if err == errDeviceExists {
+		http.Error(w, "Device already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not create device %s: %v", requestBody.DeviceID, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Created device %s", requestBody.DeviceID)
+
+	device, _ := a.devices.Get(requestBody.DeviceID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, device)
+}
+
+func (a *api) deleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := httprouter.ParamsFromContext(r.Context()).ByName("deviceID")
+	err := a.devices.Delete(deviceID)
+	if err == errDeviceNotFound {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not delete device %s: %v", deviceID, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Deleted device %s", deviceID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) rotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := httprouter.ParamsFromContext(r.Context()).ByName("deviceID")
+	var requestBody struct {
+		PublicKey string `json:"public_key"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	defer r.Body.Close()
+	if err != nil {
+		log.Printf("Could not decode body: %v", err)
+		http.Error(w, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+
+	err = a.devices.RotateKey(deviceID, []byte(requestBody.PublicKey))
+	if err == errDeviceNotFound {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not rotate key of device %s: %v", deviceID, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Rotated key of device %s", deviceID)
+
+	device, _ := a.devices.Get(deviceID)
+	writeJSON(w, device)
+}
+
+func (a *api) disableDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	a.setDisabled(w, r, true)
+}
+
+func (a *api) enableDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	a.setDisabled(w, r, false)
+}
+
+func (a *api) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	deviceID := httprouter.ParamsFromContext(r.Context()).ByName("deviceID")
+	err := a.devices.SetDisabled(deviceID, disabled)
+	if err == errDeviceNotFound {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not update device %s: %v", deviceID, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if disabled {
+		log.Printf("Disabled device %s", deviceID)
+	} else {
+		log.Printf("Enabled device %s", deviceID)
+	}
+
+	device, _ := a.devices.Get(deviceID)
+	writeJSON(w, device)
+}
+
+func (a *api) listClientsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.admin.Clients())
+}
+
+func (a *api) kickClientHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := strings.TrimPrefix(httprouter.ParamsFromContext(r.Context()).ByName("clientID"), "/")
+	err := a.admin.Kick(clientID)
+	if err == errClientNotFound {
+		http.Error(w, "Client not connected", http.StatusNotFound)
+		return
+	}
+	log.Printf("Kicked client %s", clientID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) clearSessionHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := strings.TrimPrefix(httprouter.ParamsFromContext(r.Context()).ByName("clientID"), "/")
+	if clientID == "" {
+		http.Error(w, "Client id is required", http.StatusBadRequest)
+		return
+	}
+	err := a.admin.ClearSession(clientID)
+	if err != nil {
+		log.Printf("Could not clear session of %s: %v", clientID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Cleared session of client %s", clientID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) deleteRetainedHandler(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	if topic == "" || strings.ContainsAny(topic, "#+") {
+		http.Error(w, "A topic without wildcards is required", http.StatusBadRequest)
+		return
+	}
+	err := a.admin.DeleteRetained(topic)
+	if err != nil {
+		log.Printf("Could not delete retained message of %s: %v", topic, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Deleted retained message of %s", topic)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Could not marshal data to json: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
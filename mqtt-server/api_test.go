@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIToken(t *testing.T) {
+	a := NewAPI("secret", NewDeviceRegistry(), nil)
+	tests := []struct {
+		header string
+		want   int
+	}{
+		{"Bearer secret", http.StatusOK},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer other", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"bearer secret", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/devices", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("Authorization %q: status %d, want %d", test.header, w.Code, test.want)
+		}
+	}
+}
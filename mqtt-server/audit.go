@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const auditFile = "audit.ndjson"
+
+// auditRecord is one line of the audit log. Payload is base64 encoded by
+// encoding/json.
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	ClientID string    `json:"client_id"`
+	Topic    string    `json:"topic"`
+	QoS      byte      `json:"qos"`
+	Retain   bool      `json:"retain"`
+	Payload  []byte    `json:"payload"`
+}
+
+// auditLog writes the publishes matching the topic filters to
+// newline-delimited JSON files. The file is rotated when it grows over
+// maxSize and only maxFiles rotated files are kept.
+type auditLog struct {
+	dir      string
+	filters  []string
+	maxSize  int64
+	maxFiles int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func OpenAuditLog(dir string, filters []string, maxSize int64, maxFiles int) (*auditLog, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{
+		dir:      dir,
+		filters:  filters,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	err = a.open()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(filepath.Join(a.dir, auditFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// Matches reports whether publishes to the topic are recorded
+func (a *auditLog) Matches(topic string) bool {
+	for _, filter := range a.filters {
+		if topicFilterCovers(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record writes the publish to the log if the topic matches the filters
+func (a *auditLog) Record(clientID string, topic string, qos byte, retain bool, payload []byte) error {
+	if !a.Matches(topic) {
+		return nil
+	}
+
+	line, err := json.Marshal(&auditRecord{
+		Time:     time.Now().UTC(),
+		ClientID: clientID,
+		Topic:    topic,
+		QoS:      qos,
+		Retain:   retain,
+		Payload:  payload,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.size+int64(len(line)) > a.maxSize && a.size > 0 {
+		err = a.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// rotate renames the current file with a timestamp and removes the
+// oldest rotated files
+func (a *auditLog) rotate() error {
+	err := a.file.Close()
+	if err != nil {
+		return err
+	}
+	rotated := filepath.Join(a.dir, "audit-"+time.Now().UTC().Format("20060102T150405.000000000")+".ndjson")
+	err = os.Rename(filepath.Join(a.dir, auditFile), rotated)
+	if err != nil {
+		return err
+	}
+
+	files, err := filepath.Glob(filepath.Join(a.dir, "audit-*.ndjson"))
+	if err != nil {
+		return err
+	}
+	// the names sort by rotation time
+	sort.Strings(files)
+	for len(files) > a.maxFiles {
+		err = os.Remove(files[0])
+		if err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+
+	return a.open()
+}
+
+func (a *auditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.file.Close()
+}
@@ -1,126 +1,224 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"time"
 
 	"github.com/VolantMQ/vlapi/vlauth"
 	"github.com/VolantMQ/volantmq/auth"
-	//jwt "github.com/dgrijalva/jwt-go"
+	jwt "github.com/dgrijalva/jwt-go"
+	"gopkg.in/yaml.v2"
 )
 
-// internalAuth allows all connections
-type internalAuth struct{}
+// internalAuth allows the connections without credentials on trusted
+// networks. It is not enabled by default. The clients claiming to be a
+// registered device must authenticate with deviceAuth, the ones using
+// certUser with certAuth and the ones using a service client id with
+// certAuth or serviceAuth.
+type internalAuth struct {
+	devices *deviceRegistry
+	acl     *aclAuth
+}
 
 func (a *internalAuth) Password(clientid, user, pass string) error {
+	if a.devices.Exists(deviceIDFromClientID(clientid)) || user == certUser || a.acl.isService(clientid) {
+		return vlauth.StatusDeny
+	}
 	return vlauth.StatusAllow
 }
 func (a *internalAuth) ACL(clientId, user, topic string, access vlauth.AccessType) error {
-	return vlauth.StatusAllow
+	// topic permissions are checked by aclAuth
+	return vlauth.StatusDeny
 }
 func (a *internalAuth) Shutdown() error {
 	return nil
 }
 
-func RegisterAuthManagers() {
-	err := auth.Register("internal", &internalAuth{})
-	if err != nil {
-		log.Fatalf("Could not register internal auth: %v", err)
-	}
-	//err = auth.Register("gcp", &gcpAuth{})
-	//if err != nil {
-	//	log.Fatalf("Could not register gcp auth: %v", err)
-	//}
-}
-
-func NewInternalAuthManager() *auth.Manager {
-	internalAuthManager, err := auth.NewManager([]string{"internal"}, false)
-	if err != nil {
-		log.Fatalf("Could not create internal auth manager: %v", err)
-	}
-
-	return internalAuthManager
-}
-
-/*
-func NewGCPAuth() *auth.Manager {
-	gcpAuthManager, err := auth.NewManager([]string{"gcp"}, false)
-	if err != nil {
-		log.Fatal("Could not create gcp auth manager: %v", err)
-	}
-
-	return gcpAuthManager
+// deviceAuth verifies JWTs signed with the device identity key.
+// The token is passed in the password field.
+type deviceAuth struct {
+	devices  *deviceRegistry
+	audience string
 }
 
-type gcpAuth struct{}
-
-func (a *gcpAuth) Password(clientid, user, pass string) error {
-	if user != "unused" {
+func (a *deviceAuth) Password(clientid, user, pass string) error {
+	deviceID := deviceIDFromClientID(clientid)
+	key, ok := a.devices.Key(deviceID)
+	if !ok {
 		return vlauth.StatusDeny
 	}
-
-	if clientid != "projects/auto-fleet-mgnt/locations/europe-west1/registries/fleet-registry/devices/etest" {
-		log.Printf("Unknown clientid: %v", clientid)
+	if a.devices.Disabled(deviceID) {
+		log.Printf("Device %s: disabled", deviceID)
 		return vlauth.StatusDeny
 	}
 
-	keyData, err := ioutil.ReadFile("rsa_cert.pem")
-	if err != nil {
-		log.Printf("Could not read cert file: %v", err)
-		return err
-	}
-	key, err := jwt.ParseRSAPublicKeyFromPEM(keyData)
-	if err != nil {
-		log.Printf("Could not parse cert file: %v", err)
-		return err
-	}
-
 	token, err := jwt.Parse(pass, func(token *jwt.Token) (interface{}, error) {
-		if token.Method.Alg() != "RS256" {
-			log.Printf("Invalid signing method: %v", token.Method.Alg())
-			return nil, errors.New("auth: invalid signing method")
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if token.Method.Alg() != "RS256" {
+				return nil, errors.New("auth: invalid signing method")
+			}
+		case *ecdsa.PublicKey:
+			if token.Method.Alg() != "ES256" {
+				return nil, errors.New("auth: invalid signing method")
+			}
+		default:
+			return nil, errors.New("auth: unsupported key type")
 		}
 		return key, nil
 	})
 	if err != nil {
-		log.Print(err)
+		log.Printf("Device %s: invalid token: %v", deviceID, err)
 		return vlauth.StatusDeny
 	}
 
 	claims := token.Claims.(jwt.MapClaims)
-	if !claims.VerifyAudience("auto-fleet-mgnt", true) {
-		log.Print("Invalid audience")
+	if !claims.VerifyAudience(a.audience, true) {
+		log.Printf("Device %s: invalid audience", deviceID)
 		return vlauth.StatusDeny
 	}
 
 	t := time.Now()
 	if !claims.VerifyExpiresAt(t.Unix(), true) {
-		log.Print("Invalid expires at")
+		log.Printf("Device %s: invalid expires at", deviceID)
 		return vlauth.StatusDeny
 	}
 	if !claims.VerifyIssuedAt(t.Unix(), true) {
-		log.Print("Invalid issued at")
+		log.Printf("Device %s: invalid issued at", deviceID)
 		return vlauth.StatusDeny
 	}
-	log.Print("Allowing")
 
 	return vlauth.StatusAllow
 }
-func (a *gcpAuth) ACL(clientId, user, topic string, access vlauth.AccessType) error {
-	//expClientId := fmt.Sprintf(
-	//	"projects/%s/locations/%s/registries/%s/devices/%s",
-	//	*project, *region, *registry, *device)
+func (a *deviceAuth) ACL(clientId, user, topic string, access vlauth.AccessType) error {
+	// topic permissions are checked by aclAuth
+	return vlauth.StatusDeny
+}
+func (a *deviceAuth) Shutdown() error {
+	return nil
+}
+
+// serviceAuth accepts the service clients presenting the token of their
+// client id as password. The username must be the client id.
+type serviceAuth struct {
+	// tokens by client id, a name ending with * applies to all client ids
+	// with the prefix
+	tokens  map[string]string
+	devices *deviceRegistry
+}
+
+// LoadServiceTokens reads the YAML file of the service client tokens
+func LoadServiceTokens(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens map[string]string
+	err = yaml.UnmarshalStrict(data, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	for name, token := range tokens {
+		if token == "" {
+			return nil, fmt.Errorf("empty token of %s", name)
+		}
+	}
+	return tokens, nil
+}
+
+func (a *serviceAuth) Password(clientid, user, pass string) error {
+	// registered devices must use their identity key
+	if user != clientid || user == certUser || a.devices.Exists(deviceIDFromClientID(clientid)) {
+		return vlauth.StatusDeny
+	}
+	token := ""
+	best := -1
+	for name, t := range a.tokens {
+		if n := matchClientPattern(name, clientid); n > best {
+			token = t
+			best = n
+		}
+	}
+	if token != "" && subtle.ConstantTimeCompare([]byte(pass), []byte(token)) == 1 {
+		return vlauth.StatusAllow
+	}
+	return vlauth.StatusDeny
+}
+func (a *serviceAuth) ACL(clientId, user, topic string, access vlauth.AccessType) error {
+	// topic permissions are checked by aclAuth
+	return vlauth.StatusDeny
+}
+func (a *serviceAuth) Shutdown() error {
+	return nil
+}
 
-	//log.Printf("Checking ACL: %v %v %v %v", clientId, user, topic, access)
-	//if user == "unused" &&
-	//	topic == fmt.Sprintf("/devices/%s/%s", *device, topicType) &&
-	//	clientId == expClientId {
-	//	return auth.StatusAllow
-	//}
+// certAuth accepts clients whose identity the frontend verified from
+// the TLS client certificate. The frontend replaces the credentials of
+// these clients with certUser and the token known only to this process.
+type certAuth struct {
+	token string
+}
 
-	//panic("ACL failed")
+func (a *certAuth) Password(clientid, user, pass string) error {
+	if user == certUser && subtle.ConstantTimeCompare([]byte(pass), []byte(a.token)) == 1 {
+		return vlauth.StatusAllow
+	}
 	return vlauth.StatusDeny
 }
-func (a *gcpAuth) Shutdown() error {
+func (a *certAuth) ACL(clientId, user, topic string, access vlauth.AccessType) error {
+	// topic permissions are checked by aclAuth
+	return vlauth.StatusDeny
+}
+func (a *certAuth) Shutdown() error {
 	return nil
 }
-*/
+
+func NewCertToken() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatalf("Could not generate certificate auth token: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func RegisterAuthManagers(devices *deviceRegistry, audience string, serviceTokens map[string]string, acl *aclAuth, certToken string) {
+	err := auth.Register("internal", &internalAuth{devices: devices, acl: acl})
+	if err != nil {
+		log.Fatalf("Could not register internal auth: %v", err)
+	}
+	err = auth.Register("device", &deviceAuth{devices: devices, audience: audience})
+	if err != nil {
+		log.Fatalf("Could not register device auth: %v", err)
+	}
+	err = auth.Register("service", &serviceAuth{tokens: serviceTokens, devices: devices})
+	if err != nil {
+		log.Fatalf("Could not register service auth: %v", err)
+	}
+	err = auth.Register("x509", &certAuth{token: certToken})
+	if err != nil {
+		log.Fatalf("Could not register x509 auth: %v", err)
+	}
+	err = auth.Register("acl", acl)
+	if err != nil {
+		log.Fatalf("Could not register acl auth: %v", err)
+	}
+}
+
+func NewAuthManager(providers []string) *auth.Manager {
+	authManager, err := auth.NewManager(append(providers, "x509", "acl"), false)
+	if err != nil {
+		log.Fatalf("Could not create auth manager: %v", err)
+	}
+
+	return authManager
+}
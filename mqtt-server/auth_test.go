@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/VolantMQ/vlapi/vlauth"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestDeviceAuth(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := NewDeviceRegistry()
+	devices.devices["rsa"] = &device{key: &rsaKey.PublicKey}
+	devices.devices["ec"] = &device{key: &ecKey.PublicKey}
+	devices.devices["disabled"] = &device{key: &rsaKey.PublicKey, state: deviceState{Disabled: true}}
+	a := &deviceAuth{devices: devices, audience: "auto-fleet-mgnt"}
+
+	now := time.Now().Unix()
+	valid := jwt.MapClaims{"aud": "auto-fleet-mgnt", "iat": now, "exp": now + 60}
+	// with returns the valid claims with the claim changed, or removed if v is nil
+	with := func(name string, v interface{}) jwt.MapClaims {
+		claims := jwt.MapClaims{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		if v == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = v
+		}
+		return claims
+	}
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	none := sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid)
+	hmac := sign(jwt.SigningMethodHS256, []byte("secret"), valid)
+
+	tests := []struct {
+		name     string
+		clientID string
+		token    string
+		want     error
+	}{
+		{"rs256", "rsa", sign(jwt.SigningMethodRS256, rsaKey, valid), vlauth.StatusAllow},
+		{"es256", "ec", sign(jwt.SigningMethodES256, ecKey, valid), vlauth.StatusAllow},
+		{"cloud iot client id", "projects/p/locations/l/registries/r/devices/rsa", sign(jwt.SigningMethodRS256, rsaKey, valid), vlauth.StatusAllow},
+		{"other key", "rsa", sign(jwt.SigningMethodRS256, otherKey, valid), vlauth.StatusDeny},
+		{"rs384", "rsa", sign(jwt.SigningMethodRS384, rsaKey, valid), vlauth.StatusDeny},
+		{"es256 of rsa device", "rsa", sign(jwt.SigningMethodES256, ecKey, valid), vlauth.StatusDeny},
+		{"rs256 of ec device", "ec", sign(jwt.SigningMethodRS256, rsaKey, valid), vlauth.StatusDeny},
+		{"alg none", "rsa", none, vlauth.StatusDeny},
+		{"hs256", "rsa", hmac, vlauth.StatusDeny},
+		{"not a token", "rsa", "", vlauth.StatusDeny},
+		{"other audience", "rsa", sign(jwt.SigningMethodRS256, rsaKey, with("aud", "other")), vlauth.StatusDeny},
+		{"no audience", "rsa", sign(jwt.SigningMethodRS256, rsaKey, with("aud", nil)), vlauth.StatusDeny},
+		{"expired", "rsa", sign(jwt.SigningMethodRS256, rsaKey, with("exp", now-1)), vlauth.StatusDeny},
+		{"no expiry", "rsa", sign(jwt.SigningMethodRS256, rsaKey, with("exp", nil)), vlauth.StatusDeny},
+		{"issued in future", "rsa", sign(jwt.SigningMethodRS256, rsaKey, with("iat", now+60)), vlauth.StatusDeny},
+		{"no issued at", "rsa", sign(jwt.SigningMethodRS256, rsaKey, with("iat", nil)), vlauth.StatusDeny},
+		{"unknown device", "unknown", sign(jwt.SigningMethodRS256, rsaKey, valid), vlauth.StatusDeny},
+		{"disabled device", "disabled", sign(jwt.SigningMethodRS256, rsaKey, valid), vlauth.StatusDeny},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := a.Password(test.clientID, "", test.token)
+			if got != test.want {
+				t.Errorf("Password(%s) = %v, want %v", test.clientID, got, test.want)
+			}
+		})
+	}
+}
+
+func TestServiceAuth(t *testing.T) {
+	devices := NewDeviceRegistry()
+	devices.devices["dashboard-drone"] = &device{}
+	a := &serviceAuth{
+		tokens: map[string]string{
+			"mission-control": "mc-token",
+			"dashboard-*":     "dashboard-token",
+			"dashboard-ops-*": "ops-token",
+		},
+		devices: devices,
+	}
+	tests := []struct {
+		name     string
+		clientID string
+		user     string
+		pass     string
+		want     error
+	}{
+		{"token", "mission-control", "mission-control", "mc-token", vlauth.StatusAllow},
+		{"wrong token", "mission-control", "mission-control", "dashboard-token", vlauth.StatusDeny},
+		{"empty token", "mission-control", "mission-control", "", vlauth.StatusDeny},
+		{"user is not the client id", "mission-control", "dashboard-1", "mc-token", vlauth.StatusDeny},
+		{"prefix", "dashboard-1", "dashboard-1", "dashboard-token", vlauth.StatusAllow},
+		{"longest prefix", "dashboard-ops-1", "dashboard-ops-1", "ops-token", vlauth.StatusAllow},
+		{"shorter prefix", "dashboard-ops-1", "dashboard-ops-1", "dashboard-token", vlauth.StatusDeny},
+		{"unknown client", "browser", "browser", "", vlauth.StatusDeny},
+		{"registered device", "dashboard-drone", "dashboard-drone", "dashboard-token", vlauth.StatusDeny},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := a.Password(test.clientID, test.user, test.pass)
+			if got != test.want {
+				t.Errorf("Password(%s, %s) = %v, want %v", test.clientID, test.user, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadServiceTokens(t *testing.T) {
+	dir := tempDataDir(t)
+	file := filepath.Join(dir, "services.yaml")
+	err := ioutil.WriteFile(file, []byte("mission-control: mc-token\ndashboard-*: dashboard-token\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := LoadServiceTokens(file)
+	if err != nil {
+		t.Fatalf("LoadServiceTokens: %v", err)
+	}
+	if len(tokens) != 2 || tokens["mission-control"] != "mc-token" || tokens["dashboard-*"] != "dashboard-token" {
+		t.Errorf("tokens = %v", tokens)
+	}
+
+	err = ioutil.WriteFile(file, []byte("mission-control: \"\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadServiceTokens(file); err == nil {
+		t.Error("LoadServiceTokens accepts an empty token")
+	}
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VolantMQ/vlapi/vlauth"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// echoTimeout is how long the bridge expects a forwarded message to come
+// back from its own subscription
+const echoTimeout = 10 * time.Second
+
+// bridgeTopic forwards the messages matching Pattern. The local topics are
+// LocalPrefix+Pattern and the remote topics RemotePrefix+Pattern, the
+// prefix is replaced when a message is forwarded.
+type bridgeTopic struct {
+	Pattern string `yaml:"pattern"`
+	// Direction is out (local to remote), in (remote to local) or both
+	Direction    string `yaml:"direction"`
+	QoS          byte   `yaml:"qos"`
+	LocalPrefix  string `yaml:"localPrefix"`
+	RemotePrefix string `yaml:"remotePrefix"`
+}
+
+func (t *bridgeTopic) out() bool {
+	return t.Direction == "out" || t.Direction == "both"
+}
+
+func (t *bridgeTopic) in() bool {
+	return t.Direction == "in" || t.Direction == "both"
+}
+
+type bridgeConfig struct {
+	// Address of the upstream broker, tcp://host:port or ssl://host:port.
+	// The bridge is disabled if empty.
+	Address  string `yaml:"address"`
+	ClientID string `yaml:"clientID"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// CA bundle used to verify the upstream broker, the system roots if empty
+	CA string `yaml:"ca"`
+	// Cert and Key of the client certificate, optional
+	Cert   string        `yaml:"cert"`
+	Key    string        `yaml:"key"`
+	Topics []bridgeTopic `yaml:"topics"`
+	// MinBackoff and MaxBackoff limit the reconnect delay in seconds, the
+	// delay doubles after each failed attempt
+	MinBackoff int `yaml:"minBackoff"`
+	MaxBackoff int `yaml:"maxBackoff"`
+	// QueueSize is the number of messages kept in each direction while
+	// they cannot be forwarded, the oldest are dropped when it is full
+	QueueSize int `yaml:"queueSize"`
+}
+
+type bridgeMessage struct {
+	topic   string
+	qos     byte
+	retain  bool
+	payload []byte
+}
+
+// bridge forwards messages between the local broker and an upstream broker.
+// Both connections use MQTT 3.1.1, which has no way to leave out the own
+// messages of a subscriber, so the bridge drops the messages it has
+// forwarded itself when they come back with direction both.
+//
+// The messages from upstream do not pass a frontend, the bridge checks them
+// like the frontend checks the client publishes, with the ACL, limits and
+// schemas of the bridge client id.
+type bridge struct {
+	config *bridgeConfig
+	local  mqtt.Client
+	remote mqtt.Client
+	out    *bridgeQueue
+	in     *bridgeQueue
+	lost   chan struct{}
+	closed chan struct{}
+	wg     sync.WaitGroup
+	acl    vlauth.Permissions
+	// limits of the messages forwarded in, unlimited if nil
+	limits *publishLimits
+	// schemas of the messages forwarded in, not validated if nil
+	schemas *schemaRegistry
+	// publisher reports the rejected messages to the dead-letter topics
+	publisher *serverPublisher
+	// audit records the messages forwarded in, disabled if nil
+	audit *auditLog
+	// retained stores the retained messages forwarded in, disabled if nil
+	retained retainedWriter
+
+	lock         sync.Mutex
+	localEchoes  *echoes
+	remoteEchoes *echoes
+	// limited is set while the messages from upstream are dropped by the
+	// limiter
+	limited bool
+}
+
+// NewBridge starts forwarding between the local broker listener and the
+// upstream broker of the config. The local connection is authenticated with
+// the certAuth credentials.
+func NewBridge(config *bridgeConfig, localBroker string, certToken string, acl vlauth.Permissions, limits *publishLimits, schemas *schemaRegistry, publisher *serverPublisher, audit *auditLog, retained retainedWriter) (*bridge, error) {
+	b := &bridge{
+		config:       config,
+		acl:          acl,
+		limits:       limits,
+		schemas:      schemas,
+		publisher:    publisher,
+		audit:        audit,
+		retained:     retained,
+		out:          newBridgeQueue("out", config.QueueSize),
+		in:           newBridgeQueue("in", config.QueueSize),
+		lost:         make(chan struct{}, 1),
+		closed:       make(chan struct{}),
+		localEchoes:  newEchoes(),
+		remoteEchoes: newEchoes(),
+	}
+
+	remoteOpts := mqtt.NewClientOptions().
+		AddBroker(config.Address).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetProtocolVersion(4). // Use MQTT 3.1.1
+		SetAutoReconnect(false).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			log.Printf("Bridge: connection to %s lost: %v", config.Address, err)
+			bridgeConnected.Set(0)
+			select {
+			case b.lost <- struct{}{}:
+			default:
+			}
+		})
+	if strings.HasPrefix(config.Address, "ssl://") || strings.HasPrefix(config.Address, "tls://") {
+		tlsConfig, err := NewClientTLSConfig(config.CA, config.Cert, config.Key)
+		if err != nil {
+			return nil, err
+		}
+		remoteOpts.SetTLSConfig(tlsConfig)
+	}
+	b.remote = mqtt.NewClient(remoteOpts)
+
+	localOpts := mqtt.NewClientOptions().
+		AddBroker(localBroker).
+		SetClientID(config.ClientID).
+		SetUsername(certUser).
+		SetPassword(certToken).
+		SetProtocolVersion(4). // Use MQTT 3.1.1
+		SetConnectRetry(true).
+		SetConnectRetryInterval(time.Second).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(b.subscribeLocal)
+	b.local = mqtt.NewClient(localOpts)
+	b.local.Connect()
+
+	b.wg.Add(3)
+	go b.connectRemote()
+	go b.forward(b.out, b.remote, b.remoteEchoes, b.remoteSubscribed)
+	go b.forward(b.in, b.local, b.localEchoes, b.localSubscribed)
+	return b, nil
+}
+
+// Close stops forwarding, the queued messages are dropped and counted
+func (b *bridge) Close() {
+	close(b.closed)
+	b.out.close()
+	b.in.close()
+	b.wg.Wait()
+	b.remote.Disconnect(250)
+	b.local.Disconnect(250)
+	bridgeConnected.Set(0)
+}
+
+// connectRemote keeps the upstream connection up
+func (b *bridge) connectRemote() {
+	defer b.wg.Done()
+
+	minBackoff := time.Duration(b.config.MinBackoff) * time.Second
+	maxBackoff := time.Duration(b.config.MaxBackoff) * time.Second
+	backoff := minBackoff
+	for {
+		tok := b.remote.Connect()
+		tok.Wait()
+		err := tok.Error()
+		if err == nil {
+			err = b.subscribeRemote()
+			if err != nil {
+				b.remote.Disconnect(250)
+			}
+		}
+		if err == nil {
+			log.Printf("Bridge: connected to %s", b.config.Address)
+			bridgeConnected.Set(1)
+			backoff = minBackoff
+			select {
+			case <-b.lost:
+				continue
+			case <-b.closed:
+				return
+			}
+		}
+
+		// jitter keeps the edge sites from reconnecting at the same time
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Printf("Bridge: could not connect to %s: %v, retrying in %v", b.config.Address, err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-b.closed:
+			return
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (b *bridge) subscribeRemote() error {
+	for i := range b.config.Topics {
+		t := &b.config.Topics[i]
+		if !t.in() {
+			continue
+		}
+		tok := b.remote.Subscribe(t.RemotePrefix+t.Pattern, t.QoS, func(c mqtt.Client, msg mqtt.Message) {
+			if b.isEcho(b.remoteEchoes, msg.Topic(), msg.Payload()) {
+				return
+			}
+			topic := t.LocalPrefix + strings.TrimPrefix(msg.Topic(), t.RemotePrefix)
+			if !b.allowIn(topic, msg.Payload()) {
+				return
+			}
+			b.in.push(bridgeMessage{
+				topic:   topic,
+				qos:     t.QoS,
+				retain:  msg.Retained(),
+				payload: msg.Payload(),
+			})
+		})
+		tok.Wait()
+		if err := tok.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowIn checks a message from upstream like the frontend checks the
+// client publishes
+func (b *bridge) allowIn(topic string, payload []byte) bool {
+	clientID := b.config.ClientID
+	if topicFilterCovers(stateTopicFilter, topic) || b.acl.ACL(clientID, certUser, topic, vlauth.AccessWrite) != vlauth.StatusAllow {
+		droppedMessages.WithLabelValues("acl").Inc()
+		return false
+	}
+	if b.limits != nil {
+		reason := b.limits.check(clientID, topic, len(payload))
+		b.lock.Lock()
+		limited := b.limited
+		b.limited = reason != ""
+		b.lock.Unlock()
+		if reason != "" {
+			droppedMessages.WithLabelValues(string(reason)).Inc()
+			_, kind, _ := topicKind(topic)
+			limitExceeded.WithLabelValues(kind, string(reason)).Inc()
+			if !limited {
+				log.Printf("Bridge: %s exceeded on %s, dropping messages from upstream", reason, topic)
+			}
+			return false
+		}
+	}
+	if b.schemas != nil {
+		if errs := b.schemas.Validate(topic, payload); len(errs) > 0 {
+			droppedMessages.WithLabelValues("schema").Inc()
+			log.Printf("Bridge: invalid payload on %s: %s", topic, strings.Join(errs, "; "))
+			if b.publisher != nil {
+				deviceID, _, _ := splitDeviceTopic(topic)
+				b.publisher.PublishError(deviceID, deadLetter{
+					Topic:     topic,
+					ClientID:  clientID,
+					Errors:    errs,
+					Payload:   string(payload),
+					Source:    "mqtt-server",
+					Timestamp: time.Now().UTC(),
+				})
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bridge) subscribeLocal(client mqtt.Client) {
+	for i := range b.config.Topics {
+		t := &b.config.Topics[i]
+		if !t.out() {
+			continue
+		}
+		tok := client.Subscribe(t.LocalPrefix+t.Pattern, t.QoS, func(c mqtt.Client, msg mqtt.Message) {
+			if b.isEcho(b.localEchoes, msg.Topic(), msg.Payload()) {
+				return
+			}
+			b.out.push(bridgeMessage{
+				topic:   t.RemotePrefix + strings.TrimPrefix(msg.Topic(), t.LocalPrefix),
+				qos:     t.QoS,
+				retain:  msg.Retained(),
+				payload: msg.Payload(),
+			})
+		})
+		tok.Wait()
+		if err := tok.Error(); err != nil {
+			log.Printf("Bridge: could not subscribe to %s: %v", t.LocalPrefix+t.Pattern, err)
+		}
+	}
+}
+
+// forward publishes the queued messages with client, keeping each message
+// in the queue until it has been published
+func (b *bridge) forward(q *bridgeQueue, client mqtt.Client, echoes *echoes, subscribed func(topic string) bool) {
+	defer b.wg.Done()
+
+	for {
+		msg, ok := q.peek()
+		if !ok {
+			return
+		}
+		if !client.IsConnectionOpen() {
+			select {
+			case <-time.After(100 * time.Millisecond):
+				continue
+			case <-b.closed:
+				return
+			}
+		}
+
+		echo := subscribed(msg.topic)
+		if echo {
+			b.addEcho(echoes, msg.topic, msg.payload)
+		}
+		tok := client.Publish(msg.topic, msg.qos, msg.retain, msg.payload)
+		if !tok.WaitTimeout(10*time.Second) || tok.Error() != nil {
+			if echo {
+				b.isEcho(echoes, msg.topic, msg.payload)
+			}
+			log.Printf("Bridge: could not forward %s %s: %v", q.direction, msg.topic, tok.Error())
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-b.closed:
+				return
+			}
+		}
+		q.pop()
+		bridgeMessages.WithLabelValues(q.direction).Inc()
+		// the messages from upstream do not pass a frontend
+		if q == b.in && b.audit != nil {
+			err := b.audit.Record(b.config.ClientID, msg.topic, msg.qos, msg.retain, msg.payload)
+			if err != nil {
+				log.Printf("Bridge: could not write audit log: %v", err)
+			}
+		}
+		if q == b.in && msg.retain && b.retained != nil {
+			err := b.retained.WriteRetained(msg.topic, msg.qos, msg.payload)
+			if err != nil {
+				log.Printf("Bridge: could not persist retained message: %v", err)
+			}
+		}
+	}
+}
+
+// localSubscribed reports whether the bridge gets back the messages it
+// publishes to the local topic
+func (b *bridge) localSubscribed(topic string) bool {
+	for _, t := range b.config.Topics {
+		if t.out() && topicFilterCovers(t.LocalPrefix+t.Pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteSubscribed reports whether the bridge gets back the messages it
+// publishes to the remote topic
+func (b *bridge) remoteSubscribed(topic string) bool {
+	for _, t := range b.config.Topics {
+		if t.in() && topicFilterCovers(t.RemotePrefix+t.Pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func echoKey(topic string, payload []byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write(payload)
+	return h.Sum64()
+}
+
+// echoes are the messages forwarded by the bridge that are expected back
+// from its own subscription. A local client publishing the same message
+// before the echo arrives drops the echo instead of its message, which
+// forwards the same message once either way. The echoes that do not arrive
+// in echoTimeout, for example when the broker denies the message, expire.
+type echoes struct {
+	// expires by echoKey, the oldest first
+	expires map[uint64][]time.Time
+	pruned  time.Time
+}
+
+func newEchoes() *echoes {
+	return &echoes{expires: make(map[uint64][]time.Time)}
+}
+
+func (e *echoes) add(key uint64, now time.Time) {
+	if now.Sub(e.pruned) > echoTimeout {
+		for k := range e.expires {
+			e.take(k, now, false)
+		}
+		e.pruned = now
+	}
+	e.expires[key] = append(e.expires[key], now.Add(echoTimeout))
+}
+
+// take removes the expired echoes of the key, and the oldest echo left if
+// remove is set. It returns whether an echo was left.
+func (e *echoes) take(key uint64, now time.Time, remove bool) bool {
+	expires := e.expires[key]
+	for len(expires) > 0 && now.After(expires[0]) {
+		expires = expires[1:]
+	}
+	found := len(expires) > 0
+	if found && remove {
+		expires = expires[1:]
+	}
+	if len(expires) == 0 {
+		delete(e.expires, key)
+	} else {
+		e.expires[key] = expires
+	}
+	return found
+}
+
+func (b *bridge) addEcho(echoes *echoes, topic string, payload []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	echoes.add(echoKey(topic, payload), time.Now())
+}
+
+// isEcho reports whether the message was published by the bridge and
+// removes it from the echoes
+func (b *bridge) isEcho(echoes *echoes, topic string, payload []byte) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return echoes.take(echoKey(topic, payload), time.Now(), true)
+}
+
+// bridgeQueue stores the messages of one direction until they are forwarded
+type bridgeQueue struct {
+	direction string
+	size      int
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	messages []bridgeMessage
+	// inflight is set while the first message is being forwarded
+	inflight bool
+	closed   bool
+	// dropping is set while the queue is full
+	dropping bool
+}
+
+func newBridgeQueue(direction string, size int) *bridgeQueue {
+	q := &bridgeQueue{direction: direction, size: size}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+func (q *bridgeQueue) push(msg bridgeMessage) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.messages) >= q.size {
+		if !q.dropping {
+			log.Printf("Bridge: %s queue is full, dropping the oldest messages", q.direction)
+			q.dropping = true
+		}
+		// the message being forwarded is kept for pop
+		if q.inflight && len(q.messages) > 1 {
+			q.messages[1] = q.messages[0]
+		} else if q.inflight {
+			bridgeDropped.WithLabelValues(q.direction).Inc()
+			return
+		}
+		q.messages = q.messages[1:]
+		bridgeDropped.WithLabelValues(q.direction).Inc()
+	}
+	q.messages = append(q.messages, msg)
+	bridgeQueued.WithLabelValues(q.direction).Set(float64(len(q.messages)))
+	q.cond.Signal()
+}
+
+// peek waits for the next message and marks it in flight until pop, returns
+// false when the queue is closed
+func (q *bridgeQueue) peek() (bridgeMessage, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for len(q.messages) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return bridgeMessage{}, false
+	}
+	q.inflight = true
+	return q.messages[0], true
+}
+
+func (q *bridgeQueue) pop() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.messages = q.messages[1:]
+	q.inflight = false
+	if len(q.messages) < q.size/2 {
+		q.dropping = false
+	}
+	bridgeQueued.WithLabelValues(q.direction).Set(float64(len(q.messages)))
+}
+
+func (q *bridgeQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// the message in flight is still forwarded
+	n := len(q.messages)
+	if q.inflight {
+		n--
+	}
+	if n > 0 {
+		log.Printf("Bridge: dropping %d queued %s messages", n, q.direction)
+		bridgeDropped.WithLabelValues(q.direction).Add(float64(n))
+	}
+	q.closed = true
+	q.cond.Broadcast()
+}
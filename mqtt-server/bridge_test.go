@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEchoes(t *testing.T) {
+	now := time.Now()
+	e := newEchoes()
+	e.add(1, now)
+	e.add(1, now.Add(time.Second))
+
+	if e.take(2, now, true) {
+		t.Error("take of other key")
+	}
+	if !e.take(1, now, true) || !e.take(1, now, true) {
+		t.Error("echoes not found")
+	}
+	if e.take(1, now, true) {
+		t.Error("echo taken twice")
+	}
+
+	// the echoes that never come back expire, the other echoes are kept
+	e.add(1, now)
+	e.add(2, now.Add(echoTimeout))
+	later := now.Add(echoTimeout + time.Second)
+	if e.take(1, later, true) {
+		t.Error("expired echo found")
+	}
+	if !e.take(2, later, false) {
+		t.Error("echo expired early")
+	}
+	e.add(3, later)
+	if len(e.expires) != 2 {
+		t.Errorf("%d keys after prune, want 2", len(e.expires))
+	}
+	e.add(4, later.Add(3*echoTimeout))
+	if len(e.expires) != 1 {
+		t.Errorf("%d keys after prune, want 1", len(e.expires))
+	}
+}
+
+func TestBridgeAllowIn(t *testing.T) {
+	b := &bridge{
+		config: &bridgeConfig{ClientID: "mqtt-server-bridge"},
+		acl:    newTestACL(t),
+		limits: NewPublishLimits(&limitConfig{
+			Clients: map[string]limitRule{"mqtt-server-bridge": {Rate: 1, MaxPayload: 10}},
+		}),
+	}
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		want    bool
+	}{
+		{"command", "/devices/d1/commands/control", "{}", true},
+		{"denied by acl", "/devices/d1/events/telemetry", "{}", false},
+		{"state topic", "/devices/d1/state", "{}", false},
+		{"payload size", "/devices/d1/commands/control", "01234567890", false},
+		{"rate", "/devices/d1/commands/control", "{}", false},
+	}
+	for _, test := range tests {
+		if got := b.allowIn(test.topic, []byte(test.payload)); got != test.want {
+			t.Errorf("%s: allowIn(%s) = %v, want %v", test.name, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestBridgeQueueClose(t *testing.T) {
+	q := newBridgeQueue("in", 2)
+	q.push(bridgeMessage{topic: "a"})
+	q.push(bridgeMessage{topic: "b"})
+	q.push(bridgeMessage{topic: "c"})
+	msg, ok := q.peek()
+	if !ok || msg.topic != "b" {
+		t.Fatalf("peek = %s, %v, want b", msg.topic, ok)
+	}
+
+	// the message in flight is popped after close
+	q.close()
+	if _, ok := q.peek(); ok {
+		t.Error("peek after close")
+	}
+	q.pop()
+}
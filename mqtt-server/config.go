@@ -0,0 +1,406 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/VolantMQ/vlapi/mqttp"
+	"github.com/VolantMQ/volantmq/configuration"
+	"gopkg.in/yaml.v2"
+)
+
+// Config of the mqtt-server. The values are read from the defaults, the
+// config file, the environment and the command line in that order.
+type Config struct {
+	Listeners struct {
+		TCP    string `yaml:"tcp"`
+		Health string `yaml:"health"`
+		// WebSocket serves MQTT over WebSocket on /mqtt, disabled if empty
+		WebSocket string `yaml:"webSocket"`
+		// WebSocketOrigins are host patterns of the allowed cross origin requests
+		WebSocketOrigins []string `yaml:"webSocketOrigins"`
+	} `yaml:"listeners"`
+	TLS struct {
+		// Port of the TLS listener, it is enabled if Cert is set
+		Port       string `yaml:"port"`
+		Cert       string `yaml:"cert"`
+		Key        string `yaml:"key"`
+		ClientCA   string `yaml:"clientCA"`
+		ClientAuth string `yaml:"clientAuth"`
+	} `yaml:"tls"`
+	Auth struct {
+		Providers []string `yaml:"providers"`
+		Devices   string   `yaml:"devices"`
+		Audience  string   `yaml:"audience"`
+		ACL       string   `yaml:"acl"`
+		// Services is the YAML file of the service client tokens
+		Services string `yaml:"services"`
+	} `yaml:"auth"`
+	DataDir string `yaml:"dataDir"`
+	Audit   struct {
+		// Dir of the audit log files, the audit log is disabled if empty
+		Dir       string   `yaml:"dir"`
+		Topics    []string `yaml:"topics"`
+		MaxSizeMB int      `yaml:"maxSizeMB"`
+		MaxFiles  int      `yaml:"maxFiles"`
+	} `yaml:"audit"`
+	API struct {
+		// Token of the HTTP API, the API is disabled if empty
+		Token string `yaml:"token"`
+	} `yaml:"api"`
+	// Schemas is the directory of the JSON schemas of the device topics, the
+	// payloads are not validated if empty
+	Schemas string `yaml:"schemas"`
+	// DrainPeriod is the time in seconds the connected clients are served on
+	// shutdown to complete the publishes in flight
+	DrainPeriod int `yaml:"drainPeriod"`
+	// Limits of the client publishes
+	Limits limitConfig `yaml:"limits"`
+	// Bridge to an upstream broker
+	Bridge   bridgeConfig                 `yaml:"bridge"`
+	MQTT     configuration.MqttConfig     `yaml:"mqtt"`
+	Acceptor configuration.AcceptorConfig `yaml:"acceptor"`
+}
+
+func DefaultConfig() *Config {
+	c := &Config{}
+	c.Listeners.TCP = "8883"
+	c.Listeners.Health = "8080"
+	c.Listeners.WebSocket = "8083"
+	c.TLS.Port = "8884"
+	c.TLS.ClientAuth = "request"
+	c.Auth.Providers = []string{"device", "service"}
+	c.Auth.Devices = "devices"
+	c.Auth.Audience = "auto-fleet-mgnt"
+	c.Auth.ACL = "acl.yaml"
+	c.DrainPeriod = 10
+	c.Audit.Topics = []string{"/devices/+/commands/#"}
+	c.Audit.MaxSizeMB = 100
+	c.Audit.MaxFiles = 10
+	c.Bridge.ClientID = "mqtt-server-bridge"
+	c.Bridge.MinBackoff = 1
+	c.Bridge.MaxBackoff = 60
+	c.Bridge.QueueSize = 10000
+
+	c.MQTT.Version = []string{"v3.1.1"}
+	c.MQTT.KeepAlive.Force = true
+	c.MQTT.KeepAlive.Period = 60
+	c.MQTT.Systree.Enabled = true
+	c.MQTT.Systree.UpdateInterval = 10
+	c.MQTT.Options.ConnectTimeout = 2
+	c.MQTT.Options.OfflineQoS0 = true
+	c.MQTT.Options.SessionPreempt = false
+	c.MQTT.Options.RetainAvailable = true
+	c.MQTT.Options.SubsOverlap = false
+	c.MQTT.Options.SubsID = false
+	c.MQTT.Options.ReceiveMax = 65535
+	c.MQTT.Options.MaxPacketSize = 268435455
+	c.MQTT.Options.MaxTopicAlias = 65535
+	c.MQTT.Options.MaxQoS = 2
+
+	c.Acceptor.MaxIncoming = 1000
+	c.Acceptor.PreSpawn = 10
+	return c
+}
+
+// setting is a config value that can be overridden with a command line
+// flag or an environment variable
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"tcp-port", "MQTT_TCP_PORT", "TCP listener port", setString(func(c *Config) *string { return &c.Listeners.TCP })},
+	{"health-port", "MQTT_HEALTH_PORT", "Port of the health check, metrics and API endpoints", setString(func(c *Config) *string { return &c.Listeners.Health })},
+	{"ws-port", "MQTT_WS_PORT", "WebSocket listener port, disabled if empty", setString(func(c *Config) *string { return &c.Listeners.WebSocket })},
+	{"ws-origins", "MQTT_WS_ORIGINS", "Comma separated host patterns of allowed WebSocket origins", setList(func(c *Config) *[]string { return &c.Listeners.WebSocketOrigins })},
+	{"tls-port", "MQTT_TLS_PORT", "TLS listener port", setString(func(c *Config) *string { return &c.TLS.Port })},
+	{"tls-cert", "MQTT_TLS_SERVER_CERT", "TLS server certificate, TLS listener is enabled if set", setString(func(c *Config) *string { return &c.TLS.Cert })},
+	{"tls-key", "MQTT_TLS_SERVER_KEY", "TLS server private key", setString(func(c *Config) *string { return &c.TLS.Key })},
+	{"tls-client-ca", "MQTT_TLS_CLIENT_CA", "CA bundle used to verify client certificates", setString(func(c *Config) *string { return &c.TLS.ClientCA })},
+	{"tls-client-auth", "MQTT_TLS_CLIENT_AUTH", "Client certificate mode: none, request or require", setString(func(c *Config) *string { return &c.TLS.ClientAuth })},
+	{"auth", "MQTT_AUTH", "Comma separated list of auth providers", setList(func(c *Config) *[]string { return &c.Auth.Providers })},
+	{"devices", "MQTT_DEVICES", "Directory of <device-id>.pem device identity public keys", setString(func(c *Config) *string { return &c.Auth.Devices })},
+	{"audience", "MQTT_AUDIENCE", "Expected audience of device JWTs", setString(func(c *Config) *string { return &c.Auth.Audience })},
+	{"services", "MQTT_SERVICES", "YAML file of the service client tokens by client id", setString(func(c *Config) *string { return &c.Auth.Services })},
+	{"acl", "MQTT_ACL", "YAML file with topic ACL rules, all topics are allowed if set empty", setString(func(c *Config) *string { return &c.Auth.ACL })},
+	{"data-dir", "MQTT_DATA_DIR", "Directory for persisted sessions and retained messages, kept in memory if not set", setString(func(c *Config) *string { return &c.DataDir })},
+	{"drain-period", "MQTT_DRAIN_PERIOD", "Seconds to wait for the publishes in flight on shutdown", setInt(func(c *Config) *int { return &c.DrainPeriod })},
+	{"audit-dir", "MQTT_AUDIT_DIR", "Directory of the publish audit log, disabled if not set", setString(func(c *Config) *string { return &c.Audit.Dir })},
+	{"audit-topics", "MQTT_AUDIT_TOPICS", "Comma separated topic filters of the audited publishes", setList(func(c *Config) *[]string { return &c.Audit.Topics })},
+	{"schemas", "MQTT_SCHEMAS", "Directory of the JSON schemas of the device topics, payloads are not validated if not set", setString(func(c *Config) *string { return &c.Schemas })},
+	{"api-token", "MQTT_API_TOKEN", "Bearer token of the HTTP API, disabled if not set", setString(func(c *Config) *string { return &c.API.Token })},
+	{"bridge-address", "MQTT_BRIDGE_ADDRESS", "Upstream broker of the bridge, tcp://host:port or ssl://host:port, disabled if not set", setString(func(c *Config) *string { return &c.Bridge.Address })},
+	{"bridge-client-id", "MQTT_BRIDGE_CLIENT_ID", "Client id of the bridge", setString(func(c *Config) *string { return &c.Bridge.ClientID })},
+	{"bridge-username", "MQTT_BRIDGE_USERNAME", "Username of the bridge in the upstream broker", setString(func(c *Config) *string { return &c.Bridge.Username })},
+	{"bridge-password", "MQTT_BRIDGE_PASSWORD", "Password of the bridge in the upstream broker", setString(func(c *Config) *string { return &c.Bridge.Password })},
+	{"versions", "MQTT_VERSIONS", "Comma separated list of accepted protocol versions: v3.1, v3.1.1 and v5.0", setList(func(c *Config) *[]string { return &c.MQTT.Version })},
+	{"keepalive", "MQTT_KEEPALIVE", "Keepalive period in seconds", setInt(func(c *Config) *int { return &c.MQTT.KeepAlive.Period })},
+	{"max-incoming", "MQTT_MAX_INCOMING", "Maximum number of client connections", setInt(func(c *Config) *int { return &c.Acceptor.MaxIncoming })},
+	{"pre-spawn", "MQTT_PRE_SPAWN", "Number of connection handlers started in advance", setInt(func(c *Config) *int { return &c.Acceptor.PreSpawn })},
+	{"systree-interval", "MQTT_SYSTREE_INTERVAL", "Update interval of the $SYS topics in seconds", setInt(func(c *Config) *int { return &c.MQTT.Systree.UpdateInterval })},
+}
+
+// VolantMQ defines -config for its own config format
+var configFile = flag.String("config-file", "", "YAML config file (env MQTT_CONFIG_FILE)")
+
+func init() {
+	// the flags are applied in LoadConfig when set
+	for _, s := range settings {
+		flag.String(s.flag, "", fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+}
+
+func setString(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func setList(field func(*Config) *[]string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = strings.Split(value, ",")
+		return nil
+	}
+}
+
+func setInt(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		*field(c) = i
+		return nil
+	}
+}
+
+// LoadConfig reads the config file given with -config-file and applies the
+// environment and command line overrides. flag.Parse must be called first.
+func LoadConfig() (*Config, error) {
+	c := DefaultConfig()
+
+	file := *configFile
+	if file == "" {
+		file = os.Getenv("MQTT_CONFIG_FILE")
+	}
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.UnmarshalStrict(data, c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	for _, s := range settings {
+		value, ok := os.LookupEnv(s.env)
+		if !ok {
+			continue
+		}
+		err := s.set(c, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.env, err)
+		}
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				err = s.set(c, f.Value.String())
+				if err != nil {
+					err = fmt.Errorf("-%s: %w", s.flag, err)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, c.Validate()
+}
+
+// Validate rejects the values the server would not run with
+func (c *Config) Validate() error {
+	for name, port := range map[string]string{
+		"listeners.tcp":    c.Listeners.TCP,
+		"listeners.health": c.Listeners.Health,
+		"tls.port":         c.TLS.Port,
+	} {
+		if !validPort(port) {
+			return fmt.Errorf("%s: invalid port %q", name, port)
+		}
+	}
+	if c.Listeners.WebSocket != "" && !validPort(c.Listeners.WebSocket) {
+		return fmt.Errorf("listeners.webSocket: invalid port %q", c.Listeners.WebSocket)
+	}
+
+	if c.TLS.Cert != "" && c.TLS.Key == "" {
+		return errors.New("tls.key: required with tls.cert")
+	}
+	switch c.TLS.ClientAuth {
+	case "none", "request", "require":
+	default:
+		return fmt.Errorf("tls.clientAuth: invalid mode %q", c.TLS.ClientAuth)
+	}
+
+	if len(c.Auth.Providers) == 0 {
+		return errors.New("auth.providers: at least one provider is required")
+	}
+	for _, provider := range c.Auth.Providers {
+		switch provider {
+		case "device", "service", "internal":
+		default:
+			return fmt.Errorf("auth.providers: unknown provider %q", provider)
+		}
+	}
+
+	if c.DrainPeriod < 0 {
+		return fmt.Errorf("drainPeriod: must not be negative, got %d", c.DrainPeriod)
+	}
+
+	if c.Audit.Dir != "" {
+		if len(c.Audit.Topics) == 0 {
+			return errors.New("audit.topics: at least one topic filter is required")
+		}
+		for _, topic := range c.Audit.Topics {
+			if !validTopicFilter(topic) {
+				return fmt.Errorf("audit.topics: invalid topic filter %q", topic)
+			}
+		}
+		if c.Audit.MaxSizeMB <= 0 {
+			return fmt.Errorf("audit.maxSizeMB: must be positive, got %d", c.Audit.MaxSizeMB)
+		}
+		if c.Audit.MaxFiles < 0 {
+			return fmt.Errorf("audit.maxFiles: must not be negative, got %d", c.Audit.MaxFiles)
+		}
+	}
+
+	rules := map[string]limitRule{"limits.default": c.Limits.Default}
+	for name, rule := range c.Limits.Clients {
+		rules["limits.clients."+name] = rule
+	}
+	for i, topic := range c.Limits.Topics {
+		name := fmt.Sprintf("limits.topics[%d]", i)
+		if !validTopicFilter(topic.Pattern) {
+			return fmt.Errorf("%s.pattern: invalid topic filter %q", name, topic.Pattern)
+		}
+		rules[name] = topic.limitRule
+	}
+	for name, rule := range rules {
+		if rule.Rate < 0 || rule.Burst < 0 || rule.MaxPayload < 0 {
+			return fmt.Errorf("%s: rate, burst and maxPayload must not be negative", name)
+		}
+	}
+
+	if c.Bridge.Address != "" {
+		if !strings.Contains(c.Bridge.Address, "://") {
+			return fmt.Errorf("bridge.address: missing scheme in %q", c.Bridge.Address)
+		}
+		if c.Bridge.ClientID == "" {
+			return errors.New("bridge.clientID: required with bridge.address")
+		}
+		if len(c.Bridge.Topics) == 0 {
+			return errors.New("bridge.topics: at least one topic is required")
+		}
+		for i, topic := range c.Bridge.Topics {
+			name := fmt.Sprintf("bridge.topics[%d]", i)
+			if !validTopicFilter(topic.LocalPrefix + topic.Pattern) {
+				return fmt.Errorf("%s.pattern: invalid topic filter %q", name, topic.LocalPrefix+topic.Pattern)
+			}
+			if !validTopicFilter(topic.RemotePrefix + topic.Pattern) {
+				return fmt.Errorf("%s.pattern: invalid topic filter %q", name, topic.RemotePrefix+topic.Pattern)
+			}
+			if strings.ContainsAny(topic.LocalPrefix+topic.RemotePrefix, "#+") {
+				return fmt.Errorf("%s: prefixes must not contain wildcards", name)
+			}
+			switch topic.Direction {
+			case "in", "out", "both":
+			default:
+				return fmt.Errorf("%s.direction: must be in, out or both, got %q", name, topic.Direction)
+			}
+			if topic.QoS > 2 {
+				return fmt.Errorf("%s.qos: must be between 0 and 2, got %d", name, topic.QoS)
+			}
+		}
+		if c.Bridge.MinBackoff <= 0 || c.Bridge.MaxBackoff < c.Bridge.MinBackoff {
+			return fmt.Errorf("bridge: minBackoff must be positive and maxBackoff at least minBackoff, got %d and %d", c.Bridge.MinBackoff, c.Bridge.MaxBackoff)
+		}
+		if c.Bridge.QueueSize <= 0 {
+			return fmt.Errorf("bridge.queueSize: must be positive, got %d", c.Bridge.QueueSize)
+		}
+	}
+
+	if len(c.MQTT.Version) == 0 {
+		return errors.New("mqtt.version: at least one protocol version is required")
+	}
+	for _, v := range c.MQTT.Version {
+		switch v {
+		case "v3.1", "v3.1.1", "v5.0":
+		default:
+			return fmt.Errorf("mqtt.version: unknown protocol version %q", v)
+		}
+	}
+	if c.MQTT.KeepAlive.Period < 0 || c.MQTT.KeepAlive.Period > 65535 {
+		return fmt.Errorf("mqtt.keepAlive.period: must be between 0 and 65535, got %d", c.MQTT.KeepAlive.Period)
+	}
+	if c.MQTT.Systree.Enabled && c.MQTT.Systree.UpdateInterval <= 0 {
+		return fmt.Errorf("mqtt.systree.updateInterval: must be positive, got %d", c.MQTT.Systree.UpdateInterval)
+	}
+	if c.MQTT.Options.ConnectTimeout <= 0 {
+		return fmt.Errorf("mqtt.options.connectTimeout: must be positive, got %d", c.MQTT.Options.ConnectTimeout)
+	}
+	if c.MQTT.Options.ReceiveMax == 0 {
+		return errors.New("mqtt.options.receiveMax: must be positive")
+	}
+	if c.MQTT.Options.MaxPacketSize == 0 || c.MQTT.Options.MaxPacketSize > 268435455 {
+		return fmt.Errorf("mqtt.options.maxPacketSize: must be between 1 and 268435455, got %d", c.MQTT.Options.MaxPacketSize)
+	}
+	if c.MQTT.Options.MaxQoS > mqttp.QoS2 {
+		return fmt.Errorf("mqtt.options.maxQoS: must be between 0 and 2, got %d", c.MQTT.Options.MaxQoS)
+	}
+
+	if c.Acceptor.MaxIncoming <= 0 {
+		return fmt.Errorf("acceptor.maxIncoming: must be positive, got %d", c.Acceptor.MaxIncoming)
+	}
+	if c.Acceptor.PreSpawn < 0 || c.Acceptor.PreSpawn > c.Acceptor.MaxIncoming {
+		return fmt.Errorf("acceptor.preSpawn: must be between 0 and maxIncoming, got %d", c.Acceptor.PreSpawn)
+	}
+
+	return nil
+}
+
+func validPort(port string) bool {
+	p, err := strconv.Atoi(port)
+	return err == nil && p >= 1 && p <= 65535
+}
+
+// validTopicFilter checks the placement of the wildcards
+func validTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+		if level != "#" && level != "+" && strings.ContainsAny(level, "#+") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+var (
+	errDeviceExists   = errors.New("device already exists")
+	errDeviceNotFound = errors.New("device not found")
+)
+
+// deviceRegistry holds the known devices. The public identity keys are
+// stored as <device-id>.pem and the state as <device-id>.json in the
+// devices directory.
+type deviceRegistry struct {
+	dir string
+	// states publishes the connection state changes, disabled if nil
+	states *serverPublisher
+
+	lock    sync.RWMutex
+	devices map[string]*device
+}
+
+type device struct {
+	key    crypto.PublicKey
+	keyPEM []byte
+	state  deviceState
+	// conn of the connected device, closed when the device is disabled,
+	// deleted or its key is rotated
+	conn io.Closer
+}
+
+// deviceState is persisted in <device-id>.json
+type deviceState struct {
+	Disabled bool      `json:"disabled"`
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// deviceInfo is a snapshot of a device
+type deviceInfo struct {
+	DeviceID  string     `json:"device_id"`
+	PublicKey string     `json:"public_key"`
+	Disabled  bool       `json:"disabled"`
+	Connected bool       `json:"connected"`
+	LastSeen  *time.Time `json:"last_seen"`
+}
+
+func NewDeviceRegistry() *deviceRegistry {
+	return &deviceRegistry{
+		devices: make(map[string]*device),
+	}
+}
+
+// LoadDir reads <device-id>.pem files from dir. Each file can contain
+// either a PKIX public key or a certificate with RSA or EC key.
+func (r *deviceRegistry) LoadDir(dir string) error {
+	r.dir = dir
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		keyData, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		key, err := parsePublicKey(keyData)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		deviceID := strings.TrimSuffix(filepath.Base(file), ".pem")
+		d := &device{key: key, keyPEM: keyData}
+		stateData, err := ioutil.ReadFile(filepath.Join(dir, deviceID+".json"))
+		if err == nil {
+			err = json.Unmarshal(stateData, &d.state)
+			if err != nil {
+				return fmt.Errorf("%s.json: %w", deviceID, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		r.lock.Lock()
+		r.devices[deviceID] = d
+		r.lock.Unlock()
+		log.Printf("Loaded identity key for device %s", deviceID)
+	}
+
+	return nil
+}
+
+// Key returns the identity key of the device, also when it is disabled
+func (r *deviceRegistry) Key(deviceID string) (crypto.PublicKey, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	d, ok := r.devices[deviceID]
+	if !ok {
+		return nil, false
+	}
+	return d.key, true
+}
+
+func (r *deviceRegistry) Exists(deviceID string) bool {
+	_, ok := r.Key(deviceID)
+	return ok
+}
+
+func (r *deviceRegistry) Disabled(deviceID string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	d, ok := r.devices[deviceID]
+	return ok && d.state.Disabled
+}
+
+func (r *deviceRegistry) List() []deviceInfo {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	devices := make([]deviceInfo, 0, len(r.devices))
+	for deviceID, d := range r.devices {
+		devices = append(devices, d.info(deviceID))
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+	return devices
+}
+
+func (r *deviceRegistry) Get(deviceID string) (deviceInfo, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	d, ok := r.devices[deviceID]
+	if !ok {
+		return deviceInfo{}, false
+	}
+	return d.info(deviceID), true
+}
+
+func (d *device) info(deviceID string) deviceInfo {
+	info := deviceInfo{
+		DeviceID:  deviceID,
+		PublicKey: string(d.keyPEM),
+		Disabled:  d.state.Disabled,
+		Connected: d.conn != nil,
+	}
+	if d.conn != nil {
+		now := time.Now().UTC()
+		info.LastSeen = &now
+	} else if !d.state.LastSeen.IsZero() {
+		lastSeen := d.state.LastSeen
+		info.LastSeen = &lastSeen
+	}
+	return info
+}
+
+// Create registers a new device with the PEM encoded public key
+func (r *deviceRegistry) Create(deviceID string, keyPEM []byte) error {
+	if !validDeviceID(deviceID) {
+		return fmt.Errorf("invalid device id %q", deviceID)
+	}
+	key, err := parsePublicKey(keyPEM)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.devices[deviceID]; ok {
+		return errDeviceExists
+	}
+	d := &device{key: key, keyPEM: keyPEM}
+	err = r.writeFile(deviceID+".json", d.state)
+	if err != nil {
+		return err
+	}
+	err = r.writeFile(deviceID+".pem", keyPEM)
+	if err != nil {
+		return err
+	}
+	r.devices[deviceID] = d
+	return nil
+}
+
+// RotateKey replaces the public key of the device and disconnects it
+func (r *deviceRegistry) RotateKey(deviceID string, keyPEM []byte) error {
+	key, err := parsePublicKey(keyPEM)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	d, ok := r.devices[deviceID]
+	if !ok {
+		return errDeviceNotFound
+	}
+	err = r.writeFile(deviceID+".pem", keyPEM)
+	if err != nil {
+		return err
+	}
+	d.key = key
+	d.keyPEM = keyPEM
+	r.kick(deviceID, d, "key_rotated")
+	return nil
+}
+
+// SetDisabled disables or enables the device. Disabled devices are
+// disconnected and cannot connect.
+func (r *deviceRegistry) SetDisabled(deviceID string, disabled bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	d, ok := r.devices[deviceID]
+	if !ok {
+		return errDeviceNotFound
+	}
+	state := d.state
+	state.Disabled = disabled
+	err := r.writeFile(deviceID+".json", state)
+	if err != nil {
+		return err
+	}
+	d.state = state
+	if disabled {
+		r.kick(deviceID, d, "disabled")
+	}
+	return nil
+}
+
+// Delete removes the device and disconnects it
+func (r *deviceRegistry) Delete(deviceID string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	d, ok := r.devices[deviceID]
+	if !ok {
+		return errDeviceNotFound
+	}
+	r.kick(deviceID, d, "deleted")
+	for _, file := range []string{deviceID + ".pem", deviceID + ".json"} {
+		err := os.Remove(filepath.Join(r.dir, file))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(r.devices, deviceID)
+	return nil
+}
+
+// Connected marks the device connected through conn
+func (r *deviceRegistry) Connected(deviceID string, conn io.Closer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	d, ok := r.devices[deviceID]
+	if !ok {
+		return
+	}
+	r.setConn(deviceID, d, conn, "connected")
+}
+
+// Disconnected marks the device disconnected if conn is its current connection
+func (r *deviceRegistry) Disconnected(deviceID string, conn io.Closer, reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	d, ok := r.devices[deviceID]
+	if !ok || d.conn != conn {
+		return
+	}
+	r.setConn(deviceID, d, nil, reason)
+}
+
+// MarkOffline publishes the offline state of the devices left online, for
+// example by a previous run of the server that did not shut down cleanly or
+// by connections the frontend could not close in time on shutdown
+func (r *deviceRegistry) MarkOffline(reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for deviceID, d := range r.devices {
+		if d.conn != nil || d.state.Online {
+			r.setConn(deviceID, d, nil, reason)
+		}
+	}
+}
+
+// kick closes the connection of the device. The frontend does not report
+// the disconnect, as the connection is no longer the current one.
+func (r *deviceRegistry) kick(deviceID string, d *device, reason string) {
+	if d.conn == nil {
+		return
+	}
+	log.Printf("Disconnecting device %s: %s", deviceID, reason)
+	d.conn.Close()
+	r.setConn(deviceID, d, nil, reason)
+}
+
+// setConn stores and publishes the connection state of the device
+func (r *deviceRegistry) setConn(deviceID string, d *device, conn io.Closer, reason string) {
+	d.conn = conn
+	d.state.Online = conn != nil
+	d.state.LastSeen = time.Now().UTC()
+	err := r.writeFile(deviceID+".json", d.state)
+	if err != nil {
+		log.Printf("Could not store state of device %s: %v", deviceID, err)
+	}
+	if r.states != nil {
+		state := stateOffline
+		if conn != nil {
+			state = stateOnline
+		}
+		r.states.PublishState(deviceID, state, reason)
+	}
+}
+
+// writeFile replaces the file in the devices directory. Values other than
+// []byte are written as JSON.
+func (r *deviceRegistry) writeFile(name string, v interface{}) error {
+	data, ok := v.([]byte)
+	if !ok {
+		var err error
+		data, err = json.Marshal(v)
+		if err != nil {
+			return err
+		}
+	}
+	file := filepath.Join(r.dir, name)
+	err := ioutil.WriteFile(file+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// validDeviceID accepts the ids that are safe as file names and MQTT client ids
+func validDeviceID(deviceID string) bool {
+	if deviceID == "" || strings.HasPrefix(deviceID, ".") {
+		return false
+	}
+	for _, c := range deviceID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func parsePublicKey(keyData []byte) (crypto.PublicKey, error) {
+	rsaKey, err := jwt.ParseRSAPublicKeyFromPEM(keyData)
+	if err == nil {
+		return rsaKey, nil
+	}
+	ecKey, err := jwt.ParseECPublicKeyFromPEM(keyData)
+	if err == nil {
+		return ecKey, nil
+	}
+	return nil, fmt.Errorf("not a RSA or EC public key or certificate")
+}
+
+// deviceIDFromClientID accepts both plain device ids and the Cloud IoT
+// style client ids: projects/<p>/locations/<l>/registries/<r>/devices/<id>
+func deviceIDFromClientID(clientID string) string {
+	i := strings.LastIndex(clientID, "/devices/")
+	if i < 0 {
+		return clientID
+	}
+	return clientID[i+len("/devices/"):]
+}
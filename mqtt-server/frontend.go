@@ -0,0 +1,957 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VolantMQ/vlapi/mqttp"
+	"github.com/VolantMQ/vlapi/vlauth"
+)
+
+// certUser is set as username of the CONNECT packets whose client id was
+// verified against the TLS client certificate. See certAuth.
+const certUser = "x509"
+
+// maxConnectSize limits the CONNECT packets read before the client is
+// authenticated. The fields are at most 64 KiB each.
+const maxConnectSize = 1 << 20
+
+var errPacketTooLarge = errors.New("packet too large")
+
+// frontend accepts client connections and forwards them to the broker
+// listener. VolantMQ does not enforce publish permissions, so the frontend
+// checks each PUBLISH against the ACL and drops the denied ones, as well as
+// the publishes to the device state topics and the payloads not matching
+// the topic schema.
+type frontend struct {
+	// name of the listener in the metrics
+	name     string
+	listener net.Listener
+	backend  string
+	acl      vlauth.Permissions
+	devices  *deviceRegistry
+	// certToken is used only with TLS listener
+	certToken string
+	// audit records the allowed publishes, disabled if nil
+	audit *auditLog
+	// limits of the publishes, unlimited if nil
+	limits *publishLimits
+	// schemas of the publish payloads, not validated if nil
+	schemas *schemaRegistry
+	// publisher reports the rejected publishes to the dead-letter topics
+	publisher *serverPublisher
+	// retained stores the retained messages as they are published, not
+	// stored until shutdown if nil
+	retained retainedWriter
+	// keepAlive period forced by the broker in seconds, the period of the
+	// client is used if 0
+	keepAlive int
+	// connections served at once by all frontends, the connections over
+	// the limit are closed when accepted
+	connections *connectionLimit
+	// maxPacketSize in bytes, the clients sending larger packets are
+	// disconnected
+	maxPacketSize int
+
+	lock    sync.Mutex
+	conns   map[net.Conn]struct{}
+	clients map[*frontendConn]struct{}
+	// stopped is the error of the listener when it stopped accepting
+	stopped error
+	// full is set while the connections are refused at the connection limit
+	full bool
+	// draining is set when the listener is closed on shutdown, the connected
+	// clients are served until Close
+	draining bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func (f *frontend) Serve() error {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return f.stop(err)
+		}
+		if !f.track(conn) {
+			conn.Close()
+			continue
+		}
+		go f.serveConn(conn)
+	}
+}
+
+// serveConn handles a connection accepted by track
+func (f *frontend) serveConn(conn net.Conn) {
+	defer f.untrack(conn)
+
+	f.handleConn(conn)
+}
+
+// stop records the error the listener stopped with
+func (f *frontend) stop(err error) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.stopped = err
+	return err
+}
+
+// Ready is a readiness check that passes while the listener accepts
+// connections and the broker listener can be connected
+func (f *frontend) Ready() error {
+	f.lock.Lock()
+	draining, stopped := f.draining, f.stopped
+	f.lock.Unlock()
+
+	if draining {
+		return errors.New("shutting down")
+	}
+	if stopped != nil {
+		return fmt.Errorf("listener stopped: %v", stopped)
+	}
+	backend, err := net.DialTimeout("tcp", f.backend, time.Second)
+	if err != nil {
+		return fmt.Errorf("broker not reachable: %v", err)
+	}
+	backend.Close()
+	return nil
+}
+
+// Drain stops accepting connections, the connected clients are served until
+// Close
+func (f *frontend) Drain() error {
+	f.lock.Lock()
+	if f.draining {
+		f.lock.Unlock()
+		return nil
+	}
+	f.draining = true
+	f.lock.Unlock()
+
+	return f.listener.Close()
+}
+
+// Inflight returns the number of the QoS 1 and 2 publishes not completed
+// yet by the clients or the broker
+func (f *frontend) Inflight() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n := 0
+	for c := range f.clients {
+		n += c.inflight()
+	}
+	return n
+}
+
+// Close stops accepting connections, disconnects the clients and waits
+// until the broker has closed their connections. MQTT 5 clients are told
+// the server is shutting down.
+func (f *frontend) Close() error {
+	err := f.Drain()
+
+	f.lock.Lock()
+	f.closed = true
+	clients := make([]*frontendConn, 0, len(f.clients))
+	for c := range f.clients {
+		clients = append(clients, c)
+	}
+	conns := make([]net.Conn, 0, len(f.conns))
+	for conn := range f.conns {
+		conns = append(conns, conn)
+	}
+	f.lock.Unlock()
+
+	for _, c := range clients {
+		c.setReason("server_shutdown")
+		// a stuck client must not block the shutdown
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.disconnect(mqttp.CodeServerShuttingDown)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	f.wg.Wait()
+	return err
+}
+
+func (f *frontend) isClosed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.closed
+}
+
+// track adds the accepted connection, it returns false if the frontend is
+// closed or the frontends serve the connection limit already
+func (f *frontend) track(conn net.Conn) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return false
+	}
+	if !f.connections.acquire() {
+		if !f.full {
+			log.Printf("Frontend: %d client connections, refusing new connections on %s listener", f.connections.max, f.name)
+			f.full = true
+		}
+		refusedConnections.WithLabelValues("max_connections").Inc()
+		return false
+	}
+	f.full = false
+	if f.conns == nil {
+		f.conns = make(map[net.Conn]struct{})
+	}
+	f.conns[conn] = struct{}{}
+	f.wg.Add(1)
+	return true
+}
+
+func (f *frontend) untrack(conn net.Conn) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.conns, conn)
+	f.connections.release()
+	f.wg.Done()
+}
+
+// connectionLimit is the number of client connections shared by the
+// frontends
+type connectionLimit struct {
+	max int
+
+	lock sync.Mutex
+	n    int
+}
+
+func (l *connectionLimit) acquire() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.n >= l.max {
+		return false
+	}
+	l.n++
+	return true
+}
+
+func (l *connectionLimit) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.n--
+}
+
+// frontendConn is a client connection forwarded to the broker
+type frontendConn struct {
+	conn     net.Conn
+	backend  net.Conn
+	listener string
+	devices  *deviceRegistry
+	clientID string
+	// user of the CONNECT, certUser if the client certificate was verified
+	user    string
+	version mqttp.ProtocolVersion
+	audit   *auditLog
+	limits  *publishLimits
+	schemas *schemaRegistry
+	// publisher reports the rejected publishes, see frontend
+	publisher *serverPublisher
+	retained  retainedWriter
+	// limited is set while the publishes are dropped by the limiter
+	limited bool
+	// keepAlive period of the client, the broker disconnects the client if
+	// it has not sent anything in 1.5 times the period
+	keepAlive time.Duration
+	// maxPacket is the maximum size of the packets in both directions
+	maxPacket int
+
+	writeLock sync.Mutex
+	// topicAliases of MQTT 5 clients
+	topicAliases map[uint16]string
+	// droppedQoS2 are ids of the dropped QoS 2 publishes waiting for PUBREL
+	droppedQoS2 map[mqttp.IDType]struct{}
+
+	lock sync.Mutex
+	// closed is set when the server closes the client connection
+	closed bool
+	// reason of the disconnect when known before the broker closes the
+	// connection
+	reason string
+	// received is the time of the last packet from the client
+	received time.Time
+	// connected is the time the broker accepted the client
+	connected time.Time
+	// subscriptions are the filters granted by the broker with their QoS
+	subscriptions map[string]mqttp.QosType
+	// pendingSubscriptions are the filters of the SUBSCRIBEs waiting for SUBACK
+	pendingSubscriptions map[mqttp.IDType][]string
+	// inflightToClient and inflightToBroker are the ids of the QoS 1 and 2
+	// publishes not completed yet
+	inflightToClient map[mqttp.IDType]struct{}
+	inflightToBroker map[mqttp.IDType]struct{}
+}
+
+// clientInfo is a snapshot of a connected client
+type clientInfo struct {
+	ClientID         string             `json:"client_id"`
+	Listener         string             `json:"listener"`
+	RemoteAddr       string             `json:"remote_addr"`
+	ConnectedSince   time.Time          `json:"connected_since"`
+	KeepAlive        int                `json:"keepalive"`
+	Subscriptions    []subscriptionInfo `json:"subscriptions"`
+	InflightToClient int                `json:"inflight_to_client"`
+	InflightToBroker int                `json:"inflight_to_broker"`
+}
+
+type subscriptionInfo struct {
+	Filter string `json:"filter"`
+	QoS    byte   `json:"qos"`
+}
+
+// Clients returns the clients accepted by the broker
+func (f *frontend) Clients() []clientInfo {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	clients := make([]clientInfo, 0, len(f.clients))
+	for c := range f.clients {
+		if info, ok := c.info(); ok {
+			clients = append(clients, info)
+		}
+	}
+	return clients
+}
+
+// Kick disconnects the clients with the client id, returns false if there
+// were none
+func (f *frontend) Kick(clientID string) bool {
+	var kicked []*frontendConn
+	f.lock.Lock()
+	for c := range f.clients {
+		if c.clientID == clientID {
+			kicked = append(kicked, c)
+		}
+	}
+	f.lock.Unlock()
+
+	for _, c := range kicked {
+		log.Printf("Frontend: disconnecting client %s: kicked", clientID)
+		c.setReason("kicked")
+		// a stuck client must not block the kick
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.disconnect(mqttp.CodeAdministrativeAction)
+		c.Close()
+	}
+	return len(kicked) > 0
+}
+
+// Connected reports whether a client with the client id is connected
+func (f *frontend) Connected(clientID string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for c := range f.clients {
+		if c.clientID == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *frontend) addClient(c *frontendConn) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.clients == nil {
+		f.clients = make(map[*frontendConn]struct{})
+	}
+	f.clients[c] = struct{}{}
+}
+
+func (f *frontend) removeClient(c *frontendConn) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.clients, c)
+}
+
+func (c *frontendConn) info() (clientInfo, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.connected.IsZero() {
+		return clientInfo{}, false
+	}
+	info := clientInfo{
+		ClientID:         c.clientID,
+		Listener:         c.listener,
+		RemoteAddr:       c.conn.RemoteAddr().String(),
+		ConnectedSince:   c.connected,
+		KeepAlive:        int(c.keepAlive / time.Second),
+		Subscriptions:    make([]subscriptionInfo, 0, len(c.subscriptions)),
+		InflightToClient: len(c.inflightToClient),
+		InflightToBroker: len(c.inflightToBroker),
+	}
+	for filter, qos := range c.subscriptions {
+		info.Subscriptions = append(info.Subscriptions, subscriptionInfo{Filter: filter, QoS: byte(qos)})
+	}
+	sort.Slice(info.Subscriptions, func(i, j int) bool {
+		return info.Subscriptions[i].Filter < info.Subscriptions[j].Filter
+	})
+	return info, true
+}
+
+func (c *frontendConn) inflight() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.inflightToClient) + len(c.inflightToBroker)
+}
+
+// trackPacket follows the subscriptions and the publishes in flight of the
+// forwarded packets
+func (c *frontendConn) trackPacket(raw []byte, fromClient bool) {
+	switch mqttp.Type(raw[0] >> 4) {
+	case mqttp.PUBLISH:
+		if (raw[0]>>1)&3 == 0 {
+			return
+		}
+	case mqttp.PUBACK, mqttp.PUBCOMP, mqttp.SUBSCRIBE, mqttp.SUBACK, mqttp.UNSUBSCRIBE:
+	default:
+		return
+	}
+	pkt, _, err := mqttp.Decode(c.version, raw)
+	if err != nil {
+		return
+	}
+	id, _ := pkt.ID()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	sent, acked := c.inflightToBroker, c.inflightToClient
+	if !fromClient {
+		sent, acked = c.inflightToClient, c.inflightToBroker
+	}
+	switch pkt := pkt.(type) {
+	case *mqttp.Publish:
+		sent[id] = struct{}{}
+	case *mqttp.Ack:
+		delete(acked, id)
+	case *mqttp.Subscribe:
+		var filters []string
+		pkt.ForEachTopic(func(t *mqttp.Topic) error {
+			filters = append(filters, t.Full())
+			return nil
+		})
+		c.pendingSubscriptions[id] = filters
+	case *mqttp.SubAck:
+		filters := c.pendingSubscriptions[id]
+		delete(c.pendingSubscriptions, id)
+		for i, code := range pkt.ReturnCodes() {
+			if i < len(filters) && code.Value() < 0x80 {
+				c.subscriptions[filters[i]] = mqttp.QosType(code.Value())
+			}
+		}
+	case *mqttp.UnSubscribe:
+		pkt.ForEachTopic(func(t *mqttp.Topic) error {
+			delete(c.subscriptions, t.Full())
+			return nil
+		})
+	}
+}
+
+// Close disconnects the client
+func (c *frontendConn) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+	return c.conn.Close()
+}
+
+func (c *frontendConn) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.closed
+}
+
+func (c *frontendConn) setReason(reason string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.reason == "" {
+		c.reason = reason
+	}
+}
+
+func (c *frontendConn) setReceived() {
+	c.lock.Lock()
+	c.received = time.Now()
+	c.lock.Unlock()
+}
+
+// disconnectReason tells why the broker closed the connection
+func (c *frontendConn) disconnectReason() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.reason != "" {
+		return c.reason
+	}
+	if c.keepAlive > 0 && time.Since(c.received) >= c.keepAlive*3/2 {
+		return "keepalive_timeout"
+	}
+	return "closed_by_broker"
+}
+
+func (f *frontend) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	maxSize := f.maxPacketSize
+	if maxSize > maxConnectSize {
+		maxSize = maxConnectSize
+	}
+	raw, err := readPacket(reader, maxSize)
+	if err != nil {
+		log.Printf("Frontend: could not read CONNECT from %v: %v", conn.RemoteAddr(), err)
+		if errors.Is(err, errPacketTooLarge) {
+			refusedConnections.WithLabelValues("packet_size").Inc()
+		}
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	pkt, _, err := mqttp.Decode(mqttp.ProtocolV50, raw)
+	if err != nil {
+		log.Printf("Frontend: could not decode CONNECT from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	connect, ok := pkt.(*mqttp.Connect)
+	if !ok {
+		log.Printf("Frontend: expected CONNECT from %v, got %v", conn.RemoteAddr(), pkt.Type().Name())
+		return
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		raw, err = f.verifyClientCert(tlsConn.ConnectionState(), connect, raw)
+		if err != nil {
+			log.Printf("Frontend: client %s from %v: %v", connect.ClientID(), conn.RemoteAddr(), err)
+			authFailures.WithLabelValues("certificate").Inc()
+			refuseConnect(conn, connect.Version())
+			return
+		}
+	}
+
+	user, _ := connect.Credentials()
+
+	backendConn, err := net.Dial("tcp", f.backend)
+	if err != nil {
+		log.Printf("Frontend: could not connect to broker: %v", err)
+		refuseConnect(conn, connect.Version())
+		return
+	}
+	defer backendConn.Close()
+
+	c := &frontendConn{
+		conn:         conn,
+		backend:      backendConn,
+		listener:     f.name,
+		devices:      f.devices,
+		clientID:     string(connect.ClientID()),
+		user:         string(user),
+		version:      connect.Version(),
+		audit:        f.audit,
+		limits:       f.limits,
+		schemas:      f.schemas,
+		publisher:    f.publisher,
+		retained:     f.retained,
+		keepAlive:    time.Duration(connect.KeepAlive()) * time.Second,
+		maxPacket:    f.maxPacketSize,
+		topicAliases: make(map[uint16]string),
+		droppedQoS2:  make(map[mqttp.IDType]struct{}),
+		received:     time.Now(),
+
+		subscriptions:        make(map[string]mqttp.QosType),
+		pendingSubscriptions: make(map[mqttp.IDType][]string),
+		inflightToClient:     make(map[mqttp.IDType]struct{}),
+		inflightToBroker:     make(map[mqttp.IDType]struct{}),
+	}
+	if f.keepAlive > 0 {
+		c.keepAlive = time.Duration(f.keepAlive) * time.Second
+	}
+	f.addClient(c)
+	defer f.removeClient(c)
+
+	_, err = backendConn.Write(raw)
+	if err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.forwardToClient(bufio.NewReader(backendConn))
+		close(done)
+		conn.Close()
+	}()
+
+	err = c.forwardToBroker(f.acl, reader)
+	if f.isClosed() {
+		c.setReason("server_shutdown")
+	} else {
+		c.setReason("connection_lost")
+	}
+	select {
+	case <-done:
+		// the broker closed the connection
+	default:
+		if err != nil && err != io.EOF && !f.isClosed() && !c.isClosed() {
+			log.Printf("Frontend: client %s: %v", c.clientID, err)
+		}
+	}
+
+	// let the broker close the connection so the session is offline when
+	// the handler returns
+	if tcpConn, ok := backendConn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (c *frontendConn) forwardToClient(reader *bufio.Reader) {
+	raw, err := readPacket(reader, c.maxPacket)
+	if err != nil {
+		return
+	}
+	// the broker answers the CONNECT with CONNACK
+	if mqttp.Type(raw[0]>>4) == mqttp.CONNACK {
+		pkt, _, err := mqttp.Decode(c.version, raw)
+		if err != nil {
+			return
+		}
+		code := pkt.(*mqttp.ConnAck).ReturnCode()
+		if code == mqttp.CodeSuccess {
+			c.lock.Lock()
+			c.connected = time.Now().UTC()
+			c.lock.Unlock()
+			connected := connectedClients.WithLabelValues(c.listener)
+			connected.Inc()
+			defer connected.Dec()
+			deviceID := deviceIDFromClientID(c.clientID)
+			c.devices.Connected(deviceID, c)
+			defer func() {
+				c.devices.Disconnected(deviceID, c, c.disconnectReason())
+			}()
+		} else {
+			authFailures.WithLabelValues(fmt.Sprintf("0x%02x", code.Value())).Inc()
+		}
+	}
+
+	for {
+		c.trackPacket(raw, false)
+		err = c.writeClient(raw)
+		if err != nil {
+			return
+		}
+		raw, err = readPacket(reader, c.maxPacket)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *frontendConn) forwardToBroker(acl vlauth.Permissions, reader *bufio.Reader) error {
+	for {
+		raw, err := readPacket(reader, c.maxPacket)
+		if err != nil {
+			return err
+		}
+		c.setReceived()
+
+		switch mqttp.Type(raw[0] >> 4) {
+		case mqttp.PUBLISH:
+			pkt, _, err := mqttp.Decode(c.version, raw)
+			if err != nil {
+				return err
+			}
+			publish := pkt.(*mqttp.Publish)
+			topic := c.publishTopic(publish)
+			if topicFilterCovers(stateTopicFilter, topic) || acl.ACL(c.clientID, c.user, topic, vlauth.AccessWrite) != vlauth.StatusAllow {
+				droppedMessages.WithLabelValues("acl").Inc()
+				err = c.dropPublish(publish, mqttp.CodeNotAuthorized)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if c.limits != nil {
+				if reason := c.limits.check(c.clientID, topic, len(publish.Payload())); reason != "" {
+					droppedMessages.WithLabelValues(string(reason)).Inc()
+					_, kind, _ := topicKind(topic)
+					limitExceeded.WithLabelValues(kind, string(reason)).Inc()
+					if c.limits.config.Disconnect {
+						c.setReason(string(reason))
+						c.disconnect(reason.disconnectCode())
+						return fmt.Errorf("disconnected, %s exceeded on %s", reason, topic)
+					}
+					if !c.limited {
+						log.Printf("Frontend: client %s: %s exceeded on %s, dropping publishes", c.clientID, reason, topic)
+						c.limited = true
+					}
+					err = c.dropPublish(publish, reason.pubAckCode())
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				c.limited = false
+			}
+			if c.schemas != nil {
+				if errs := c.schemas.Validate(topic, publish.Payload()); len(errs) > 0 {
+					droppedMessages.WithLabelValues("schema").Inc()
+					log.Printf("Frontend: client %s: invalid payload on %s: %s", c.clientID, topic, strings.Join(errs, "; "))
+					c.reject(topic, publish.Payload(), errs)
+					err = c.dropPublish(publish, mqttp.CodeInvalidPayloadFormat)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			countPublish(c.devices, topic)
+			if c.audit != nil {
+				err = c.audit.Record(c.clientID, topic, byte(publish.QoS()), publish.Retain(), publish.Payload())
+				if err != nil {
+					log.Printf("Frontend: could not write audit log: %v", err)
+				}
+			}
+			if publish.Retain() && c.retained != nil {
+				err = c.retained.WriteRetained(topic, byte(publish.QoS()), publish.Payload())
+				if err != nil {
+					log.Printf("Frontend: could not persist retained message: %v", err)
+				}
+			}
+		case mqttp.DISCONNECT:
+			c.setReason("disconnect")
+		case mqttp.PUBREL:
+			pkt, _, err := mqttp.Decode(c.version, raw)
+			if err != nil {
+				return err
+			}
+			id, _ := pkt.ID()
+			if _, ok := c.droppedQoS2[id]; ok {
+				delete(c.droppedQoS2, id)
+				comp := mqttp.NewPubComp(c.version)
+				comp.SetPacketID(id)
+				err = c.writeClientPacket(comp)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		c.trackPacket(raw, true)
+		_, err = c.backend.Write(raw)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// publishTopic resolves the topic of the PUBLISH, including MQTT 5 topic aliases
+func (c *frontendConn) publishTopic(publish *mqttp.Publish) string {
+	prop := publish.PropertyGet(mqttp.PropertyTopicAlias)
+	if prop == nil {
+		return publish.Topic()
+	}
+	alias, err := prop.AsShort()
+	if err != nil {
+		return publish.Topic()
+	}
+	if publish.Topic() != "" {
+		c.topicAliases[alias] = publish.Topic()
+		return publish.Topic()
+	}
+	return c.topicAliases[alias]
+}
+
+// reject publishes the dead letter of the publish to the error topic of the
+// device
+func (c *frontendConn) reject(topic string, payload []byte, errs []string) {
+	if c.publisher == nil {
+		return
+	}
+	deviceID, _, _ := splitDeviceTopic(topic)
+	c.publisher.PublishError(deviceID, deadLetter{
+		Topic:     topic,
+		ClientID:  c.clientID,
+		Errors:    errs,
+		Payload:   string(payload),
+		Source:    "mqtt-server",
+		Timestamp: time.Now().UTC(),
+	})
+}
+
+// dropPublish acknowledges the PUBLISH to the client without forwarding it.
+// MQTT 5 clients get the reason code.
+func (c *frontendConn) dropPublish(publish *mqttp.Publish, code mqttp.ReasonCode) error {
+	id, _ := publish.ID()
+	switch publish.QoS() {
+	case mqttp.QoS1:
+		ack := mqttp.NewPubAck(c.version)
+		ack.SetPacketID(id)
+		if c.version == mqttp.ProtocolV50 {
+			ack.SetReason(code)
+		}
+		return c.writeClientPacket(ack)
+	case mqttp.QoS2:
+		c.droppedQoS2[id] = struct{}{}
+		rec := mqttp.NewPubRec(c.version)
+		rec.SetPacketID(id)
+		if c.version == mqttp.ProtocolV50 {
+			rec.SetReason(code)
+		}
+		return c.writeClientPacket(rec)
+	}
+	return nil
+}
+
+// disconnect tells MQTT 5 clients why the connection is closed
+func (c *frontendConn) disconnect(code mqttp.ReasonCode) {
+	if c.version != mqttp.ProtocolV50 {
+		return
+	}
+	pkt := mqttp.NewDisconnect(c.version)
+	pkt.SetReasonCode(code)
+	c.writeClientPacket(pkt)
+}
+
+func (c *frontendConn) writeClientPacket(pkt mqttp.IFace) error {
+	raw, err := mqttp.Encode(pkt)
+	if err != nil {
+		return err
+	}
+	return c.writeClient(raw)
+}
+
+func (c *frontendConn) writeClient(raw []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.conn.Write(raw)
+	return err
+}
+
+// verifyClientCert binds the client id to the TLS client certificate.
+// Registered devices must present a certificate with their identity key,
+// other clients a certificate issued by the client CA with the client id as
+// common name. The verified clients get the certAuth credentials.
+func (f *frontend) verifyClientCert(state tls.ConnectionState, connect *mqttp.Connect, raw []byte) ([]byte, error) {
+	if len(state.PeerCertificates) == 0 {
+		return raw, nil
+	}
+
+	clientID := string(connect.ClientID())
+	cert := state.PeerCertificates[0]
+	if key, ok := f.devices.Key(deviceIDFromClientID(clientID)); ok {
+		registered, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		presented, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(registered, presented) {
+			return nil, errors.New("certificate does not match the device identity key")
+		}
+		if f.devices.Disabled(deviceIDFromClientID(clientID)) {
+			return nil, errors.New("device is disabled")
+		}
+	} else if len(state.VerifiedChains) == 0 || cert.Subject.CommonName != clientID {
+		return nil, errors.New("certificate is not issued to the client")
+	}
+
+	err := connect.SetCredentials([]byte(certUser), []byte(f.certToken))
+	if err != nil {
+		return nil, err
+	}
+	return mqttp.Encode(connect)
+}
+
+func refuseConnect(conn net.Conn, version mqttp.ProtocolVersion) {
+	ack := mqttp.NewConnAck(version)
+	if version == mqttp.ProtocolV50 {
+		ack.SetReturnCode(mqttp.CodeNotAuthorized)
+	} else {
+		ack.SetReturnCode(mqttp.CodeRefusedNotAuthorized)
+	}
+	raw, err := mqttp.Encode(ack)
+	if err == nil {
+		conn.Write(raw)
+	}
+}
+
+// readPacket reads one MQTT control packet including the fixed header. The
+// packets over maxSize bytes are not read.
+func readPacket(r *bufio.Reader, maxSize int) ([]byte, error) {
+	header := make([]byte, 1, 5)
+	var err error
+	header[0], err = r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length := 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, b)
+		length |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if len(header)+length > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes", errPacketTooLarge, len(header)+length)
+	}
+	packet := make([]byte, len(header)+length)
+	copy(packet, header)
+	_, err = io.ReadFull(r, packet[len(header):])
+	if err != nil {
+		return nil, fmt.Errorf("read packet: %w", err)
+	}
+	return packet, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VolantMQ/vlapi/mqttp"
+	"github.com/VolantMQ/vlapi/vlauth"
+)
+
+// bufferConn records the packets written to the connection
+type bufferConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func (c *bufferConn) Close() error {
+	return nil
+}
+
+// packets describes the written packets, the PUBLISH by topic and the other
+// packets by type and reason code
+func (c *bufferConn) packets(t *testing.T) []string {
+	var packets []string
+	reader := bufio.NewReader(&c.written)
+	for {
+		raw, err := readPacket(reader, maxConnectSize)
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		pkt, _, err := mqttp.Decode(mqttp.ProtocolV50, raw)
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		switch pkt := pkt.(type) {
+		case *mqttp.Publish:
+			packets = append(packets, "PUBLISH "+pkt.Topic())
+		case *mqttp.Ack:
+			packets = append(packets, fmt.Sprintf("%s 0x%02x", pkt.Type().Name(), pkt.Reason().Value()))
+		case *mqttp.Disconnect:
+			packets = append(packets, fmt.Sprintf("DISCONNECT 0x%02x", pkt.ReasonCode().Value()))
+		default:
+			packets = append(packets, pkt.Type().Name())
+		}
+	}
+}
+
+func encodePackets(t *testing.T, packets ...mqttp.IFace) []byte {
+	var b []byte
+	for _, pkt := range packets {
+		raw, err := mqttp.Encode(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = append(b, raw...)
+	}
+	return b
+}
+
+func testPublish(t *testing.T, id mqttp.IDType, qos mqttp.QosType, topic string, payload string) *mqttp.Publish {
+	pkt := mqttp.NewPublish(mqttp.ProtocolV50)
+	err := pkt.Set(topic, []byte(payload), qos, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt.SetPacketID(id)
+	return pkt
+}
+
+func TestFrontendPublish(t *testing.T) {
+	schemas, err := LoadSchemas("schemas")
+	if err != nil {
+		t.Fatalf("LoadSchemas: %v", err)
+	}
+	pubRel := mqttp.NewPubRel(mqttp.ProtocolV50)
+	pubRel.SetPacketID(2)
+	const telemetry = "/devices/d1/events/telemetry"
+
+	tests := []struct {
+		name     string
+		clientID string
+		user     string
+		// allowAll uses an ACL without rules
+		allowAll bool
+		limits   limitConfig
+		packets  []mqttp.IFace
+		// wantBroker are the packets forwarded to the broker and
+		// wantClient the packets the frontend sent to the client
+		wantBroker []string
+		wantClient []string
+		wantErr    bool
+	}{
+		{
+			name:       "allowed",
+			clientID:   "d1",
+			packets:    []mqttp.IFace{testPublish(t, 1, mqttp.QoS1, telemetry, "{}")},
+			wantBroker: []string{"PUBLISH " + telemetry},
+		},
+		{
+			name:       "denied by acl",
+			clientID:   "d1",
+			packets:    []mqttp.IFace{testPublish(t, 1, mqttp.QoS1, "/devices/d2/events/telemetry", "{}")},
+			wantClient: []string{"PUBACK 0x87"},
+		},
+		{
+			name:       "service with certificate",
+			clientID:   "mission-control",
+			user:       certUser,
+			packets:    []mqttp.IFace{testPublish(t, 1, mqttp.QoS1, "/devices/d1/commands/control", `{"Command":"land"}`)},
+			wantBroker: []string{"PUBLISH /devices/d1/commands/control"},
+		},
+		{
+			name:     "state topic without rules",
+			clientID: "d1",
+			allowAll: true,
+			packets: []mqttp.IFace{
+				testPublish(t, 1, mqttp.QoS1, "/devices/d1/state", "{}"),
+				testPublish(t, 0, mqttp.QoS0, "/devices/d2/state", "{}"),
+				testPublish(t, 0, mqttp.QoS0, telemetry, "{}"),
+			},
+			wantBroker: []string{"PUBLISH " + telemetry},
+			wantClient: []string{"PUBACK 0x87"},
+		},
+		{
+			name:       "invalid payload",
+			clientID:   "d1",
+			packets:    []mqttp.IFace{testPublish(t, 1, mqttp.QoS1, "/devices/d1/events/flight-plan", `{}`)},
+			wantClient: []string{"PUBACK 0x99"},
+		},
+		{
+			name:       "payload size",
+			clientID:   "d1",
+			limits:     limitConfig{Default: limitRule{MaxPayload: 2}},
+			packets:    []mqttp.IFace{testPublish(t, 1, mqttp.QoS1, telemetry, `{"a":1}`)},
+			wantClient: []string{"PUBACK 0x83"},
+		},
+		{
+			name:     "rate",
+			clientID: "d1",
+			limits:   limitConfig{Default: limitRule{Rate: 1}},
+			packets: []mqttp.IFace{
+				testPublish(t, 1, mqttp.QoS1, telemetry, "{}"),
+				testPublish(t, 2, mqttp.QoS1, telemetry, "{}"),
+			},
+			wantBroker: []string{"PUBLISH " + telemetry},
+			wantClient: []string{"PUBACK 0x97"},
+		},
+		{
+			name:     "rate with disconnect",
+			clientID: "d1",
+			limits:   limitConfig{Default: limitRule{Rate: 1}, Disconnect: true},
+			packets: []mqttp.IFace{
+				testPublish(t, 1, mqttp.QoS1, telemetry, "{}"),
+				testPublish(t, 2, mqttp.QoS1, telemetry, "{}"),
+				testPublish(t, 3, mqttp.QoS1, telemetry, "{}"),
+			},
+			wantBroker: []string{"PUBLISH " + telemetry},
+			wantClient: []string{"DISCONNECT 0x96"},
+			wantErr:    true,
+		},
+		{
+			name:     "dropped qos 2",
+			clientID: "d1",
+			packets: []mqttp.IFace{
+				testPublish(t, 2, mqttp.QoS2, "/devices/d2/events/telemetry", "{}"),
+				pubRel,
+			},
+			wantClient: []string{"PUBREC 0x87", "PUBCOMP 0x00"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var acl vlauth.Permissions = newTestACL(t)
+			if test.allowAll {
+				acl = &aclAuth{devices: NewDeviceRegistry()}
+			}
+			client := &bufferConn{}
+			broker := &bufferConn{}
+			c := &frontendConn{
+				conn:         client,
+				backend:      broker,
+				devices:      NewDeviceRegistry(),
+				clientID:     test.clientID,
+				user:         test.user,
+				version:      mqttp.ProtocolV50,
+				limits:       NewPublishLimits(&test.limits),
+				schemas:      schemas,
+				maxPacket:    maxConnectSize,
+				topicAliases: make(map[uint16]string),
+				droppedQoS2:  make(map[mqttp.IDType]struct{}),
+				received:     time.Now(),
+
+				subscriptions:        make(map[string]mqttp.QosType),
+				pendingSubscriptions: make(map[mqttp.IDType][]string),
+				inflightToClient:     make(map[mqttp.IDType]struct{}),
+				inflightToBroker:     make(map[mqttp.IDType]struct{}),
+			}
+			err := c.forwardToBroker(acl, bufio.NewReader(bytes.NewReader(encodePackets(t, test.packets...))))
+			if (err != io.EOF) != test.wantErr {
+				t.Errorf("forwardToBroker = %v, want error %v", err, test.wantErr)
+			}
+			if got := strings.Join(broker.packets(t), ", "); got != strings.Join(test.wantBroker, ", ") {
+				t.Errorf("forwarded %s, want %s", got, strings.Join(test.wantBroker, ", "))
+			}
+			if got := strings.Join(client.packets(t), ", "); got != strings.Join(test.wantClient, ", ") {
+				t.Errorf("sent to client %s, want %s", got, strings.Join(test.wantClient, ", "))
+			}
+		})
+	}
+}
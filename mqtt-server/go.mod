@@ -5,6 +5,14 @@ go 1.14
 require (
 	github.com/VolantMQ/vlapi v0.4.4
 	github.com/VolantMQ/volantmq v0.3.2
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/eclipse/paho.mqtt.golang v1.3.2
+	github.com/julienschmidt/httprouter v1.3.0
+	github.com/prometheus/client_golang v1.2.1
 	github.com/troian/healthcheck v0.1.2
+	github.com/xeipuuv/gojsonschema v1.2.0
 	gitlab.com/VolantMQ/vlplugin/persistence/mem v0.0.3
+	go.etcd.io/bbolt v1.3.5
+	gopkg.in/yaml.v2 v2.4.0
+	nhooyr.io/websocket v1.8.6
 )
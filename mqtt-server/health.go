@@ -1,6 +1,9 @@
 package main
 
 import (
+	"encoding/json"
+	"log"
+	"net/http"
 	"sync"
 
 	"github.com/troian/healthcheck"
@@ -52,3 +55,73 @@ func (t *healthChecks) RemoveReadinessCheck(name string) error {
 
 	return nil
 }
+
+type checkStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkStatus `json:"checks"`
+}
+
+// LiveEndpoint runs the liveness checks
+func (t *healthChecks) LiveEndpoint(w http.ResponseWriter, r *http.Request) {
+	t.handle(w, r, t.livenessChecks)
+}
+
+// ReadyEndpoint runs the liveness and readiness checks
+func (t *healthChecks) ReadyEndpoint(w http.ResponseWriter, r *http.Request) {
+	t.handle(w, r, t.livenessChecks, t.readinessChecks)
+}
+
+func (t *healthChecks) handle(w http.ResponseWriter, r *http.Request, checks ...map[string]healthcheck.Check) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// copy the checks, the checks can take time and they are not run under the lock
+	run := make(map[string]healthcheck.Check)
+	t.healthLock.Lock()
+	for _, c := range checks {
+		for name, check := range c {
+			run[name] = check
+		}
+	}
+	t.healthLock.Unlock()
+
+	result := healthStatus{
+		Status: "ok",
+		Checks: make(map[string]checkStatus),
+	}
+	for name, check := range run {
+		err := check()
+		if err != nil {
+			result.Status = "failed"
+			result.Checks[name] = checkStatus{Status: "failed", Error: err.Error()}
+		} else {
+			result.Checks[name] = checkStatus{Status: "ok"}
+		}
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Could not marshal health status to json: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
+
+// Handle registers /live and /ready to mux
+func (t *healthChecks) Handle(mux *http.ServeMux) {
+	mux.HandleFunc("/live", t.LiveEndpoint)
+	mux.HandleFunc("/ready", t.ReadyEndpoint)
+}
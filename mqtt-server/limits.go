@@ -0,0 +1,219 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/VolantMQ/vlapi/mqttp"
+)
+
+// limitRule limits the publishes of a client. Zero values are unlimited.
+type limitRule struct {
+	// Rate is the sustained number of publishes per second
+	Rate float64 `yaml:"rate"`
+	// Burst is the number of publishes allowed at once, Rate rounded up if 0
+	Burst int `yaml:"burst"`
+	// MaxPayload is the maximum payload size in bytes
+	MaxPayload int `yaml:"maxPayload"`
+}
+
+// topicLimit applies to the publishes to the topics matching Pattern
+type topicLimit struct {
+	Pattern   string `yaml:"pattern"`
+	limitRule `yaml:",inline"`
+}
+
+type limitConfig struct {
+	// Default applies to every client without a Clients entry
+	Default limitRule `yaml:"default"`
+	// Clients by client id. A name ending with * applies to all client ids
+	// with the prefix.
+	Clients map[string]limitRule `yaml:"clients"`
+	// Topics limits are counted per client, the first matching pattern applies
+	Topics []topicLimit `yaml:"topics"`
+	// Disconnect closes the connection of a client exceeding a limit
+	// instead of dropping the publish
+	Disconnect bool `yaml:"disconnect"`
+}
+
+// client returns the rule of the client, exact names are preferred over
+// the longest matching prefix
+func (c *limitConfig) client(clientID string) limitRule {
+	rule := c.Default
+	best := -1
+	for name, r := range c.Clients {
+		if n := matchClientPattern(name, clientID); n > best {
+			rule = r
+			best = n
+		}
+	}
+	return rule
+}
+
+// limitReason tells which limit a publish exceeded
+type limitReason string
+
+const (
+	limitRate    limitReason = "rate_limit"
+	limitPayload limitReason = "payload_size"
+)
+
+// pubAckCode is the MQTT 5 reason code of the dropped publish
+func (r limitReason) pubAckCode() mqttp.ReasonCode {
+	if r == limitRate {
+		return mqttp.CodeQuotaExceeded
+	}
+	return mqttp.CodeImplementationSpecificError
+}
+
+// disconnectCode is the MQTT 5 reason code of the disconnected client
+func (r limitReason) disconnectCode() mqttp.ReasonCode {
+	if r == limitRate {
+		return mqttp.CodeMessageRateTooHigh
+	}
+	return mqttp.CodePacketTooLarge
+}
+
+// tokenBucket allows rate publishes per second on average and burst at once
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rule limitRule) *tokenBucket {
+	if rule.Rate <= 0 {
+		return nil
+	}
+	burst := float64(rule.Burst)
+	if burst == 0 {
+		burst = math.Ceil(rule.Rate)
+	}
+	return &tokenBucket{rate: rule.Rate, burst: burst, tokens: burst}
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket has refilled by now
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// publishLimits keeps the limiters of the clients by client id, so
+// reconnecting does not reset the buckets. The limiters are shared by all
+// listeners.
+type publishLimits struct {
+	config *limitConfig
+
+	lock    sync.Mutex
+	clients map[string]*publishLimiter
+	pruned  time.Time
+}
+
+func NewPublishLimits(config *limitConfig) *publishLimits {
+	return &publishLimits{
+		config:  config,
+		clients: make(map[string]*publishLimiter),
+	}
+}
+
+// check returns the limit the publish exceeds or "" if it is allowed
+func (p *publishLimits) check(clientID string, topic string, payloadSize int) limitReason {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(p.pruned) > time.Minute {
+		p.prune(now)
+	}
+	l, ok := p.clients[clientID]
+	if !ok {
+		l = newPublishLimiter(p.config, clientID)
+		p.clients[clientID] = l
+	}
+	return l.check(now, topic, payloadSize)
+}
+
+// prune removes the limiters whose buckets have refilled, they are the
+// same as new ones
+func (p *publishLimits) prune(now time.Time) {
+	for clientID, l := range p.clients {
+		if l.idle(now) {
+			delete(p.clients, clientID)
+		}
+	}
+	p.pruned = now
+}
+
+// publishLimiter enforces the limits of one client
+type publishLimiter struct {
+	client       limitRule
+	clientBucket *tokenBucket
+	topics       []topicLimit
+	topicBuckets []*tokenBucket
+}
+
+func newPublishLimiter(config *limitConfig, clientID string) *publishLimiter {
+	l := &publishLimiter{
+		client: config.client(clientID),
+		topics: config.Topics,
+	}
+	l.clientBucket = newTokenBucket(l.client)
+	l.topicBuckets = make([]*tokenBucket, len(config.Topics))
+	for i, topic := range config.Topics {
+		l.topicBuckets[i] = newTokenBucket(topic.limitRule)
+	}
+	return l
+}
+
+func (l *publishLimiter) check(now time.Time, topic string, payloadSize int) limitReason {
+	if l.client.MaxPayload > 0 && payloadSize > l.client.MaxPayload {
+		return limitPayload
+	}
+	match := -1
+	for i, t := range l.topics {
+		if topicFilterCovers(t.Pattern, topic) {
+			match = i
+			break
+		}
+	}
+	if match >= 0 && l.topics[match].MaxPayload > 0 && payloadSize > l.topics[match].MaxPayload {
+		return limitPayload
+	}
+
+	// a publish dropped by the topic limit does not use the client's tokens
+	if match >= 0 && l.topicBuckets[match] != nil && !l.topicBuckets[match].take(now) {
+		return limitRate
+	}
+	if l.clientBucket != nil && !l.clientBucket.take(now) {
+		return limitRate
+	}
+	return ""
+}
+
+func (l *publishLimiter) idle(now time.Time) bool {
+	if l.clientBucket != nil && !l.clientBucket.full(now) {
+		return false
+	}
+	for _, b := range l.topicBuckets {
+		if b != nil && !b.full(now) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if b := newTokenBucket(limitRule{}); b != nil {
+		t.Fatal("bucket without rate")
+	}
+
+	now := time.Now()
+	b := newTokenBucket(limitRule{Rate: 2, Burst: 3})
+	for i := 0; i < 3; i++ {
+		if !b.take(now) {
+			t.Fatalf("take %d of burst refused", i)
+		}
+	}
+	if b.take(now) {
+		t.Error("take over burst allowed")
+	}
+	if b.full(now) {
+		t.Error("empty bucket is full")
+	}
+	// 2 tokens per second
+	if !b.take(now.Add(500*time.Millisecond)) || b.take(now.Add(500*time.Millisecond)) {
+		t.Error("one token not refilled in 0.5 seconds")
+	}
+	// the tokens are capped at burst
+	later := now.Add(time.Hour)
+	if !b.full(later) {
+		t.Error("bucket not full after an hour")
+	}
+	for i := 0; i < 3; i++ {
+		if !b.take(later) {
+			t.Fatalf("take %d after refill refused", i)
+		}
+	}
+	if b.take(later) {
+		t.Error("refilled over burst")
+	}
+
+	// the burst defaults to the rate rounded up
+	b = newTokenBucket(limitRule{Rate: 1.5})
+	if !b.take(now) || !b.take(now) || b.take(now) {
+		t.Error("burst of rate 1.5 is not 2")
+	}
+}
+
+func TestLimitConfigClient(t *testing.T) {
+	c := &limitConfig{
+		Default: limitRule{Rate: 1},
+		Clients: map[string]limitRule{
+			"mission-control": {Rate: 2},
+			"dashboard-*":     {Rate: 3},
+			"dashboard-ops-*": {Rate: 4},
+		},
+	}
+	tests := []struct {
+		clientID string
+		want     float64
+	}{
+		{"mission-control", 2},
+		{"mission-control-2", 1},
+		{"dashboard-1", 3},
+		{"dashboard-ops-1", 4},
+		{"d1", 1},
+	}
+	for _, test := range tests {
+		if got := c.client(test.clientID).Rate; got != test.want {
+			t.Errorf("rate of %s = %g, want %g", test.clientID, got, test.want)
+		}
+	}
+}
+
+func TestPublishLimiter(t *testing.T) {
+	config := &limitConfig{
+		Default: limitRule{Rate: 1, Burst: 2, MaxPayload: 100},
+		Topics: []topicLimit{
+			{Pattern: "/devices/+/events/flight-plan", limitRule: limitRule{Rate: 1, Burst: 1, MaxPayload: 10}},
+			{Pattern: "/devices/#", limitRule: limitRule{MaxPayload: 50}},
+		},
+	}
+	const telemetry, plan = "/devices/d1/events/telemetry", "/devices/d1/events/flight-plan"
+	now := time.Now()
+	tests := []struct {
+		name    string
+		topic   string
+		payload int
+		want    limitReason
+	}{
+		{"client payload", "/other", 101, limitPayload},
+		{"first topic payload", plan, 11, limitPayload},
+		{"second topic payload", telemetry, 51, limitPayload},
+		{"topic rate", plan, 1, ""},
+		{"topic rate exceeded", plan, 1, limitRate},
+		// the publish dropped by the topic rate does not use the client tokens
+		{"client rate", telemetry, 1, ""},
+		{"client rate exceeded", telemetry, 1, limitRate},
+	}
+	l := newPublishLimiter(config, "d1")
+	for _, test := range tests {
+		if got := l.check(now, test.topic, test.payload); got != test.want {
+			t.Errorf("%s: check(%s, %d) = %q, want %q", test.name, test.topic, test.payload, got, test.want)
+		}
+	}
+	if l.idle(now) {
+		t.Error("limiter with empty buckets is idle")
+	}
+	if !l.idle(now.Add(time.Minute)) {
+		t.Error("limiter is not idle after a minute")
+	}
+}
+
+func TestPublishLimits(t *testing.T) {
+	p := NewPublishLimits(&limitConfig{Default: limitRule{Rate: 1}})
+	if p.check("d1", "/devices/d1/events/telemetry", 1) != "" {
+		t.Fatal("first publish limited")
+	}
+	// the buckets are kept by client id over reconnects
+	if p.check("d1", "/devices/d1/events/telemetry", 1) != limitRate {
+		t.Error("second publish of d1 not limited")
+	}
+	if p.check("d2", "/devices/d2/events/telemetry", 1) != "" {
+		t.Error("publish of d2 limited by d1")
+	}
+
+	p.prune(time.Now().Add(time.Minute))
+	if len(p.clients) != 0 {
+		t.Errorf("%d limiters after prune, want 0", len(p.clients))
+	}
+}
@@ -1,17 +1,28 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
-	"github.com/VolantMQ/volantmq/configuration"
+	"github.com/VolantMQ/vlapi/vlpersistence"
 	"github.com/VolantMQ/volantmq/server"
 	"github.com/VolantMQ/volantmq/transport"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	persistenceMem "gitlab.com/VolantMQ/vlplugin/persistence/mem"
 )
 
+// internalConnections are the broker connections reserved over
+// acceptor.maxIncoming for the state publisher, the bridge, the admin API
+// and the readiness checks
+const internalConnections = 16
+
 func transportStatus(id string, status string) {
 	log.Println("Listener status:", id, status)
 }
@@ -20,16 +31,82 @@ func onDuplicate(s string, b bool) {
 }
 
 func main() {
-	RegisterAuthManagers()
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		err := replay(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		return
+	}
 
-	persist, _ := persistenceMem.Load(nil, nil)
-	healthChecks := NewHealthChecks()
-	mqttConfig, acceptorConfig := GetConfigs()
+	flag.Parse()
 
+	config, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	devices := NewDeviceRegistry()
+	err = devices.LoadDir(config.Auth.Devices)
+	if err != nil {
+		log.Fatalf("Could not load device keys: %v", err)
+	}
+	var rules *aclRules
+	if config.Auth.ACL != "" {
+		rules, err = LoadACLRules(config.Auth.ACL)
+		if err != nil {
+			log.Fatalf("Could not load ACL rules: %v", err)
+		}
+	} else {
+		log.Printf("ACL is not set, all topics are allowed")
+	}
+	var serviceTokens map[string]string
+	if config.Auth.Services != "" {
+		serviceTokens, err = LoadServiceTokens(config.Auth.Services)
+		if err != nil {
+			log.Fatalf("Could not load service tokens: %v", err)
+		}
+	}
+	acl := &aclAuth{rules: rules, devices: devices}
+	certToken := NewCertToken()
+	RegisterAuthManagers(devices, config.Auth.Audience, serviceTokens, acl, certToken)
+
+	var persist vlpersistence.IFace
+	var retained retainedWriter
+	if config.DataDir != "" {
+		boltPersist, err := OpenBoltPersistence(config.DataDir)
+		if err != nil {
+			log.Fatalf("Could not open persistence: %v", err)
+		}
+		persist = boltPersist
+		retained = boltPersist
+	} else {
+		persist, _ = persistenceMem.Load(nil, nil)
+	}
+	var audit *auditLog
+	if config.Audit.Dir != "" {
+		audit, err = OpenAuditLog(config.Audit.Dir, config.Audit.Topics, int64(config.Audit.MaxSizeMB)<<20, config.Audit.MaxFiles)
+		if err != nil {
+			log.Fatalf("Could not open audit log: %v", err)
+		}
+	}
+	limits := NewPublishLimits(&config.Limits)
+	var schemas *schemaRegistry
+	if config.Schemas != "" {
+		schemas, err = LoadSchemas(config.Schemas)
+		if err != nil {
+			log.Fatalf("Could not load schemas: %v", err)
+		}
+		log.Printf("Validating payloads with %d schemas", schemas.Len())
+	}
+	healthChecks := NewHealthChecks()
+	// the broker also serves the clients of the server itself
+	acceptor := config.Acceptor
+	acceptor.MaxIncoming += internalConnections
 	serverConfig := server.Config{
 		Health:          healthChecks,
-		MQTT:            mqttConfig,
-		Acceptor:        acceptorConfig,
+		MQTT:            config.MQTT,
+		Acceptor:        acceptor,
 		TransportStatus: transportStatus,
 		Persistence:     persist,
 		OnDuplicate:     onDuplicate,
@@ -40,55 +117,236 @@ func main() {
 		log.Fatalf("Could not create mqtt server: %v", err)
 	}
 
-	internalAuthManager := NewInternalAuthManager()
-	internalTransportConfig := transport.Config{
-		Port:        "8883",
-		AuthManager: internalAuthManager,
+	authManager := NewAuthManager(config.Auth.Providers)
+	// clients connect through the frontend, the broker listens only on loopback
+	transportConfig := transport.Config{
+		Host:        "127.0.0.1",
+		Port:        "1883",
+		AuthManager: authManager,
 	}
-	err = srv.ListenAndServe(transport.NewConfigTCP(&internalTransportConfig))
+	err = srv.ListenAndServe(transport.NewConfigTCP(&transportConfig))
 	if err != nil {
 		log.Fatalf("Could not listen tcp: %v", err)
 	}
-	/*
-		gcpAuthManager:= NewGCPAuthManager()
-		gcpTransportConfig := transport.Config{
-			Port:        "8884",
-			AuthManager: gcpAuthManager,
+
+	publisher := NewServerPublisher("tcp://"+transportConfig.Host+":"+transportConfig.Port, certToken, retained)
+	devices.states = publisher
+	devices.MarkOffline("server_restart")
+	var mqttBridge *bridge
+	if config.Bridge.Address != "" {
+		mqttBridge, err = NewBridge(&config.Bridge, "tcp://"+transportConfig.Host+":"+transportConfig.Port, certToken, acl, limits, schemas, publisher, audit, retained)
+		if err != nil {
+			log.Fatalf("Could not create bridge: %v", err)
 		}
-		err = srv.ListenAndServe(transport.NewConfigTCP(&gcpTransportConfig))
+	}
+	keepAlive := 0
+	if config.MQTT.KeepAlive.Force {
+		keepAlive = config.MQTT.KeepAlive.Period
+	}
+
+	// the frontends share the client connections
+	connections := &connectionLimit{max: config.Acceptor.MaxIncoming}
+	listener, err := net.Listen("tcp", ":"+config.Listeners.TCP)
+	if err != nil {
+		log.Fatalf("Could not listen tcp: %v", err)
+	}
+	tcpFrontend := &frontend{
+		name:      "tcp",
+		listener:  listener,
+		backend:   transportConfig.Host + ":" + transportConfig.Port,
+		acl:       acl,
+		devices:   devices,
+		audit:     audit,
+		limits:    limits,
+		schemas:   schemas,
+		publisher: publisher,
+		retained:  retained,
+		keepAlive: keepAlive,
+
+		connections:   connections,
+		maxPacketSize: int(config.MQTT.Options.MaxPacketSize),
+	}
+	frontends := []*frontend{tcpFrontend}
+	healthChecks.AddReadinessCheck("frontend:"+config.Listeners.TCP, tcpFrontend.Ready)
+	go func() {
+		transportStatus(":"+config.Listeners.TCP, "started")
+		err := tcpFrontend.Serve()
+		transportStatus(":"+config.Listeners.TCP, err.Error())
+	}()
+
+	if config.TLS.Cert != "" {
+		tlsConfig, err := NewTLSConfig(config.TLS.Cert, config.TLS.Key, config.TLS.ClientCA, config.TLS.ClientAuth)
 		if err != nil {
-			log.Fatalf("Could not listen tcp: %v", err)
+			log.Fatalf("Could not create TLS config: %v", err)
 		}
-	*/
+		listener, err := tls.Listen("tcp", ":"+config.TLS.Port, tlsConfig)
+		if err != nil {
+			log.Fatalf("Could not listen tls: %v", err)
+		}
+		tlsFrontend := &frontend{
+			name:      "tls",
+			listener:  listener,
+			backend:   transportConfig.Host + ":" + transportConfig.Port,
+			acl:       acl,
+			devices:   devices,
+			certToken: certToken,
+			audit:     audit,
+			limits:    limits,
+			schemas:   schemas,
+			publisher: publisher,
+			retained:  retained,
+			keepAlive: keepAlive,
+
+			connections:   connections,
+			maxPacketSize: int(config.MQTT.Options.MaxPacketSize),
+		}
+		frontends = append(frontends, tlsFrontend)
+		healthChecks.AddReadinessCheck("frontend:"+config.TLS.Port, tlsFrontend.Ready)
+		go func() {
+			transportStatus(":"+config.TLS.Port, "started")
+			err := tlsFrontend.Serve()
+			transportStatus(":"+config.TLS.Port, err.Error())
+		}()
+	}
+
+	if config.Listeners.WebSocket != "" {
+		listener, err := net.Listen("tcp", ":"+config.Listeners.WebSocket)
+		if err != nil {
+			log.Fatalf("Could not listen websocket: %v", err)
+		}
+		wsFrontend := &frontend{
+			name:      "websocket",
+			listener:  listener,
+			backend:   transportConfig.Host + ":" + transportConfig.Port,
+			acl:       acl,
+			devices:   devices,
+			audit:     audit,
+			limits:    limits,
+			schemas:   schemas,
+			publisher: publisher,
+			retained:  retained,
+			keepAlive: keepAlive,
+
+			connections:   connections,
+			maxPacketSize: int(config.MQTT.Options.MaxPacketSize),
+		}
+		frontends = append(frontends, wsFrontend)
+		healthChecks.AddReadinessCheck("frontend:"+config.Listeners.WebSocket, wsFrontend.Ready)
+		go func() {
+			transportStatus(":"+config.Listeners.WebSocket+"/mqtt", "started")
+			err := wsFrontend.ServeWebSocket(config.Listeners.WebSocketOrigins)
+			transportStatus(":"+config.Listeners.WebSocket+"/mqtt", err.Error())
+		}()
+	}
+
+	maxConnections.Set(float64(config.Acceptor.MaxIncoming))
+	persistedSessions, err := persist.Sessions()
+	if err != nil {
+		log.Fatalf("Could not get persisted sessions: %v", err)
+	}
+	RegisterSessionMetrics(persistedSessions)
+
+	mux := http.NewServeMux()
+	healthChecks.Handle(mux)
+	mux.Handle("/metrics", promhttp.Handler())
+	if config.API.Token != "" {
+		admin := &admin{
+			frontends: frontends,
+			broker:    "tcp://" + transportConfig.Host + ":" + transportConfig.Port,
+			certToken: certToken,
+			retained:  retained,
+		}
+		NewAPI(config.API.Token, devices, admin).Handle(mux)
+	} else {
+		log.Printf("API token is not set, the device and admin APIs are disabled")
+	}
+	go func() {
+		err := http.ListenAndServe(":"+config.Listeners.Health, mux)
+		if err != nil {
+			log.Fatalf("Could not serve health checks: %v", err)
+		}
+	}()
 
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-ch
 	log.Printf("Received quit signal: %v", sig.String())
+
+	// stop accepting connections and let the clients complete the publishes
+	// in flight before disconnecting them
+	for _, f := range frontends {
+		f.Drain()
+	}
+	drain(frontends, time.Duration(config.DrainPeriod)*time.Second, ch)
+	for _, f := range frontends {
+		f.Close()
+	}
+	devices.MarkOffline("server_shutdown")
+	publisher.Close(5 * time.Second)
+	if mqttBridge != nil {
+		mqttBridge.Close()
+	}
+	if audit != nil {
+		audit.Close()
+	}
+	// the broker takes the sessions offline after closing the connections,
+	// it does not finish shutdown if a durable session is still online
+	time.Sleep(500 * time.Millisecond)
+
+	// sessions are persisted on shutdown, the retained messages are stored
+	// as they are published and again on shutdown
+	done := make(chan struct{})
+	go func() {
+		err := srv.Shutdown()
+		if err != nil {
+			log.Printf("Could not shutdown mqtt server: %v", err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		log.Printf("Timed out waiting for mqtt server shutdown")
+	}
+
+	err = persist.Shutdown()
+	if err != nil {
+		log.Printf("Could not shutdown persistence: %v", err)
+	}
 }
 
-func GetConfigs() (configuration.MqttConfig, configuration.AcceptorConfig) {
-	mqttConfig := configuration.MqttConfig{}
-	mqttConfig.Version = []string{"v3.1.1"}
-	mqttConfig.KeepAlive.Force = true
-	mqttConfig.KeepAlive.Period = 60
-	mqttConfig.Systree.Enabled = true
-	mqttConfig.Systree.UpdateInterval = 10
-	mqttConfig.Options.ConnectTimeout = 2
-	mqttConfig.Options.OfflineQoS0 = true
-	mqttConfig.Options.SessionPreempt = false
-	mqttConfig.Options.RetainAvailable = true
-	mqttConfig.Options.SubsOverlap = false
-	mqttConfig.Options.SubsID = false
-	mqttConfig.Options.ReceiveMax = 65535
-	mqttConfig.Options.MaxPacketSize = 268435455
-	mqttConfig.Options.MaxTopicAlias = 65535
-	mqttConfig.Options.MaxQoS = 2
-
-	acceptorConfig := configuration.AcceptorConfig{
-		MaxIncoming: 1000,
-		PreSpawn:    10,
-	}
-
-	return mqttConfig, acceptorConfig
+// drain waits until the clients have no publishes in flight, at most period.
+// A second quit signal stops the wait.
+func drain(frontends []*frontend, period time.Duration, signals <-chan os.Signal) {
+	deadline := time.After(period)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	// the broker forwards a publish only after acknowledging it, so the
+	// clients must be idle twice in a row
+	idle := 0
+	for {
+		inflight := 0
+		for _, f := range frontends {
+			inflight += f.Inflight()
+		}
+		if inflight == 0 {
+			idle++
+			if idle == 2 {
+				return
+			}
+		} else {
+			idle = 0
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			log.Printf("Drain period ended with %d publishes in flight", inflight)
+			return
+		case sig := <-signals:
+			log.Printf("Received quit signal: %v, skipping drain", sig.String())
+			return
+		}
+	}
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/VolantMQ/vlapi/vlpersistence"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	connectedClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mqtt_connected_clients",
+		Help: "Clients connected through the listener.",
+	}, []string{"listener"})
+	maxConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_max_connections",
+		Help: "Maximum number of client connections, acceptor.maxIncoming.",
+	})
+	publishedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_published_messages_total",
+		Help: "Publishes forwarded to the broker. Publishes of registered devices to /devices/<device>/<kind>/<subfolder> are counted by device, kind and subfolder, others with kind other.",
+	}, []string{"device", "kind", "subfolder"})
+	droppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_dropped_messages_total",
+		Help: "Publishes dropped by the frontend and messages from upstream dropped by the bridge.",
+	}, []string{"reason"})
+	aclDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_acl_denied_total",
+		Help: "Publishes (write) and subscriptions (read) denied by the topic ACL.",
+	}, []string{"access"})
+	limitExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_limit_exceeded_total",
+		Help: "Publishes exceeding the rate or payload size limits by topic kind.",
+	}, []string{"kind", "reason"})
+	refusedConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_refused_connections_total",
+		Help: "Connections closed by the frontend before the CONNECT was forwarded, at max_connections or for a CONNECT over the packet_size limit.",
+	}, []string{"reason"})
+	authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_auth_failures_total",
+		Help: "Refused connections by the CONNACK code of the broker, or certificate for the ones refused by the frontend.",
+	}, []string{"reason"})
+	bridgeConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_bridge_connected",
+		Help: "1 if the bridge is connected to the upstream broker.",
+	})
+	bridgeMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_bridge_messages_total",
+		Help: "Messages forwarded by the bridge, out to the upstream broker and in from it.",
+	}, []string{"direction"})
+	bridgeQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mqtt_bridge_queued_messages",
+		Help: "Messages waiting to be forwarded by the bridge.",
+	}, []string{"direction"})
+	bridgeDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_bridge_dropped_messages_total",
+		Help: "Messages dropped by the bridge because the queue was full or the server stopped.",
+	}, []string{"direction"})
+)
+
+// maxSubfolders is the number of subfolders counted by name for each device
+// and kind, the publishes to the other subfolders have subfolder other
+const maxSubfolders = 20
+
+// countedSubfolders keeps the subfolder labels by device and kind
+var countedSubfolders = struct {
+	sync.Mutex
+	names map[string]map[string]bool
+}{names: make(map[string]map[string]bool)}
+
+// topicKind splits /devices/<device>/<kind>/<subfolder> topics, the kind of
+// other topics is other
+func topicKind(topic string) (device string, kind string, subfolder string) {
+	// "", "devices", device, kind, subfolder...
+	levels := strings.SplitN(topic, "/", 5)
+	if len(levels) >= 4 && levels[0] == "" && levels[1] == "devices" && (levels[3] == "events" || levels[3] == "commands") {
+		if len(levels) == 5 {
+			subfolder = strings.SplitN(levels[4], "/", 2)[0]
+		}
+		return levels[2], levels[3], subfolder
+	}
+	return "", "other", ""
+}
+
+// countPublish counts a publish forwarded to the broker. The labels come
+// from the topic, so only the registered devices are counted by device.
+func countPublish(devices *deviceRegistry, topic string) {
+	device, kind, subfolder := topicKind(topic)
+	if kind == "other" || !devices.Exists(device) {
+		publishedMessages.WithLabelValues("", "other", "").Inc()
+		return
+	}
+
+	countedSubfolders.Lock()
+	key := device + "/" + kind
+	names := countedSubfolders.names[key]
+	if names == nil {
+		names = make(map[string]bool)
+		countedSubfolders.names[key] = names
+	}
+	if !names[subfolder] {
+		if len(names) < maxSubfolders {
+			names[subfolder] = true
+		} else {
+			subfolder = "other"
+		}
+	}
+	countedSubfolders.Unlock()
+	publishedMessages.WithLabelValues(device, kind, subfolder).Inc()
+}
+
+// RegisterSessionMetrics adds the session count gauge. VolantMQ keeps the
+// persisted sessions in sync with the live ones, including the offline
+// durable sessions.
+func RegisterSessionMetrics(sessions vlpersistence.Sessions) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mqtt_sessions",
+		Help: "Sessions in the broker including the offline durable sessions.",
+	}, func() float64 {
+		return float64(sessions.Count())
+	})
+}
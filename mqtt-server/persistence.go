@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/VolantMQ/vlapi/mqttp"
+	"github.com/VolantMQ/vlapi/vlpersistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketRetained = []byte("retained")
+	bucketSessions = []byte("sessions")
+	bucketSystem   = []byte("system")
+
+	bucketQoS0  = []byte("qos0")
+	bucketQoS12 = []byte("qos12")
+	bucketUnAck = []byte("unack")
+
+	keyState = []byte("state")
+	keyInfo  = []byte("info")
+)
+
+// boltPersistence stores retained messages and persistent sessions to
+// a bbolt database so they survive broker restarts
+type boltPersistence struct {
+	db  *bolt.DB
+	r   boltRetained
+	s   boltSessions
+	sys boltSystem
+}
+
+// persistedState is the stored form of vlpersistence.SessionState
+type persistedState struct {
+	Subscriptions []byte                       `json:"subscriptions,omitempty"`
+	Expire        *vlpersistence.SessionDelays `json:"expire,omitempty"`
+	Timestamp     string                       `json:"timestamp"`
+	Version       byte                         `json:"version"`
+}
+
+func OpenBoltPersistence(dataDir string) (*boltPersistence, error) {
+	err := os.MkdirAll(dataDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(filepath.Join(dataDir, "mqtt-server.db"), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketRetained, bucketSessions, bucketSystem} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		system := tx.Bucket(bucketSystem)
+		if system.Get(keyInfo) == nil {
+			info, err := json.Marshal(&vlpersistence.SystemState{
+				Version:   "1",
+				CreatedAt: time.Now().Format(time.RFC3339),
+			})
+			if err != nil {
+				return err
+			}
+			err = system.Put(keyInfo, info)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	p := &boltPersistence{db: db}
+	p.r.db = db
+	p.s.db = db
+	p.sys.db = db
+
+	return p, nil
+}
+
+func (p *boltPersistence) System() (vlpersistence.System, error) {
+	return &p.sys, nil
+}
+
+func (p *boltPersistence) Sessions() (vlpersistence.Sessions, error) {
+	return &p.s, nil
+}
+
+func (p *boltPersistence) Retained() (vlpersistence.Retained, error) {
+	return &p.r, nil
+}
+
+func (p *boltPersistence) Shutdown() error {
+	return p.db.Close()
+}
+
+// retainedWriter stores the retained messages as they are published.
+// VolantMQ stores them only on shutdown, so they would be lost if the
+// server does not shut down cleanly.
+type retainedWriter interface {
+	// WriteRetained stores the retained message of the topic, an empty
+	// payload removes it
+	WriteRetained(topic string, qos byte, payload []byte) error
+}
+
+func (p *boltPersistence) WriteRetained(topic string, qos byte, payload []byte) error {
+	return p.r.write(topic, qos, payload)
+}
+
+type boltSystem struct {
+	db *bolt.DB
+}
+
+func (s *boltSystem) GetInfo() (*vlpersistence.SystemState, error) {
+	state := &vlpersistence.SystemState{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return json.Unmarshal(tx.Bucket(bucketSystem).Get(keyInfo), state)
+	})
+	return state, err
+}
+
+// boltRetained keeps the retained messages by topic
+type boltRetained struct {
+	db *bolt.DB
+}
+
+func (r *boltRetained) Load() ([]*vlpersistence.PersistedPacket, error) {
+	var packets []*vlpersistence.PersistedPacket
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRetained).ForEach(func(k, v []byte) error {
+			pkt := &vlpersistence.PersistedPacket{}
+			err := json.Unmarshal(v, pkt)
+			if err != nil {
+				return err
+			}
+			packets = append(packets, pkt)
+			return nil
+		})
+	})
+	return packets, err
+}
+
+func (r *boltRetained) Store(packets []*vlpersistence.PersistedPacket) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(bucketRetained)
+		if err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucket(bucketRetained)
+		if err != nil {
+			return err
+		}
+		for _, pkt := range packets {
+			topic, data, err := retainedV5(pkt.Data)
+			if err != nil {
+				log.Printf("Could not persist retained message: %v", err)
+				continue
+			}
+			err = putRetained(bucket, topic, &vlpersistence.PersistedPacket{ExpireAt: pkt.ExpireAt, Data: data})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// write stores the retained message like the broker does on shutdown, the
+// QoS 0 messages are not kept
+func (r *boltRetained) write(topic string, qos byte, payload []byte) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketRetained)
+		if len(payload) == 0 || qos == 0 {
+			return bucket.Delete([]byte(topic))
+		}
+		data, err := encodeRetained(topic, payload, mqttp.QosType(qos))
+		if err != nil {
+			return err
+		}
+		return putRetained(bucket, topic, &vlpersistence.PersistedPacket{Data: data})
+	})
+}
+
+// retainedV5 returns the topic and the retained message encoded as MQTT 5.
+// VolantMQ stores retained messages in the version they were published with
+// but decodes them as MQTT 5 when loading. The packets are MQTT 5 already if
+// they decode as MQTT 5 and encode back to the same bytes.
+func retainedV5(data []byte) (string, []byte, error) {
+	pkt, _, err := mqttp.Decode(mqttp.ProtocolV50, data)
+	if err == nil {
+		encoded, err := mqttp.Encode(pkt)
+		if publish, ok := pkt.(*mqttp.Publish); ok && err == nil && bytes.Equal(encoded, data) {
+			return publish.Topic(), data, nil
+		}
+	}
+
+	pkt, _, err = mqttp.Decode(mqttp.ProtocolV311, data)
+	if err != nil {
+		return "", nil, err
+	}
+	publish, ok := pkt.(*mqttp.Publish)
+	if !ok {
+		return "", nil, fmt.Errorf("unexpected retained %s", pkt.Type().Name())
+	}
+	data, err = encodeRetained(publish.Topic(), publish.Payload(), publish.QoS())
+	return publish.Topic(), data, err
+}
+
+// encodeRetained encodes the retained message as MQTT 5
+func encodeRetained(topic string, payload []byte, qos mqttp.QosType) ([]byte, error) {
+	v5 := mqttp.NewPublish(mqttp.ProtocolV50)
+	err := v5.Set(topic, payload, qos, true, false)
+	if err != nil {
+		return nil, err
+	}
+	v5.SetPacketID(0)
+	return mqttp.Encode(v5)
+}
+
+func (r *boltRetained) Wipe() error {
+	return r.Store(nil)
+}
+
+type boltSessions struct {
+	db *bolt.DB
+}
+
+var _ vlpersistence.Sessions = (*boltSessions)(nil)
+
+// session returns the bucket of the session or nil if it does not exist
+func session(tx *bolt.Tx, id []byte) *bolt.Bucket {
+	return tx.Bucket(bucketSessions).Bucket(id)
+}
+
+func (s *boltSessions) Exists(id []byte) bool {
+	exists := false
+	s.db.View(func(tx *bolt.Tx) error {
+		exists = session(tx, id) != nil
+		return nil
+	})
+	return exists
+}
+
+func (s *boltSessions) Count() uint64 {
+	var count uint64
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).ForEach(func(_, _ []byte) error {
+			count++
+			return nil
+		})
+	})
+	return count
+}
+
+func (s *boltSessions) Create(id []byte, state *vlpersistence.SessionBase) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if session(tx, id) != nil {
+			return vlpersistence.ErrAlreadyExists
+		}
+		_, err := createSession(tx, id, state)
+		return err
+	})
+}
+
+func createSession(tx *bolt.Tx, id []byte, state *vlpersistence.SessionBase) (*bolt.Bucket, error) {
+	ses, err := tx.Bucket(bucketSessions).CreateBucket(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range [][]byte{bucketQoS0, bucketQoS12, bucketUnAck} {
+		_, err = ses.CreateBucket(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = putState(ses, &persistedState{
+		Timestamp: state.Timestamp,
+		Version:   state.Version,
+	})
+	return ses, err
+}
+
+func (s *boltSessions) Delete(id []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketSessions).DeleteBucket(id)
+		if err == bolt.ErrBucketNotFound {
+			return vlpersistence.ErrNotFound
+		}
+		return err
+	})
+}
+
+func (s *boltSessions) LoadForEach(loader vlpersistence.SessionLoader, context interface{}) error {
+	type entry struct {
+		id    []byte
+		state *vlpersistence.SessionState
+	}
+	var entries []entry
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).ForEach(func(id, _ []byte) error {
+			st, err := getState(session(tx, id))
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry{
+				id: append([]byte(nil), id...),
+				state: &vlpersistence.SessionState{
+					Subscriptions: st.Subscriptions,
+					Expire:        st.Expire,
+					SessionBase: vlpersistence.SessionBase{
+						Timestamp: st.Timestamp,
+						Version:   st.Version,
+					},
+				},
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// loader may call back to the persistence, so it is not called within the transaction
+	for _, e := range entries {
+		err = loader.LoadSession(context, e.id, e.state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltSessions) updateState(id []byte, update func(*persistedState)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		ses := session(tx, id)
+		if ses == nil {
+			return vlpersistence.ErrNotFound
+		}
+		st, err := getState(ses)
+		if err != nil {
+			return err
+		}
+		update(st)
+		return putState(ses, st)
+	})
+}
+
+func (s *boltSessions) SubscriptionsStore(id []byte, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		ses := session(tx, id)
+		if ses == nil {
+			// subscriptions of the sessions not persisted yet are stored on shutdown
+			var err error
+			ses, err = createSession(tx, id, &vlpersistence.SessionBase{
+				Timestamp: time.Now().Format(time.RFC3339),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		st, err := getState(ses)
+		if err != nil {
+			return err
+		}
+		st.Subscriptions = data
+		return putState(ses, st)
+	})
+}
+
+func (s *boltSessions) SubscriptionsDelete(id []byte) error {
+	return s.updateState(id, func(st *persistedState) {
+		st.Subscriptions = nil
+	})
+}
+
+func (s *boltSessions) StateStore(id []byte, state *vlpersistence.SessionState) error {
+	return s.updateState(id, func(st *persistedState) {
+		if len(state.Subscriptions) > 0 {
+			st.Subscriptions = state.Subscriptions
+		}
+		st.Expire = state.Expire
+		st.Timestamp = state.Timestamp
+		st.Version = state.Version
+	})
+}
+
+func (s *boltSessions) StateDelete(id []byte) error {
+	return s.updateState(id, func(st *persistedState) {
+		*st = persistedState{}
+	})
+}
+
+func (s *boltSessions) ExpiryStore(id []byte, delays *vlpersistence.SessionDelays) error {
+	return s.updateState(id, func(st *persistedState) {
+		st.Expire = delays
+	})
+}
+
+func (s *boltSessions) ExpiryDelete(id []byte) error {
+	return s.updateState(id, func(st *persistedState) {
+		st.Expire = nil
+	})
+}
+
+func (s *boltSessions) packetCount(id []byte, name []byte) (uint64, error) {
+	var count uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ses := session(tx, id)
+		if ses == nil {
+			return vlpersistence.ErrNotFound
+		}
+		count = uint64(ses.Bucket(name).Stats().KeyN)
+		return nil
+	})
+	return count, err
+}
+
+func (s *boltSessions) PacketCountQoS0(id []byte) (uint64, error) {
+	return s.packetCount(id, bucketQoS0)
+}
+
+func (s *boltSessions) PacketCountQoS12(id []byte) (uint64, error) {
+	return s.packetCount(id, bucketQoS12)
+}
+
+func (s *boltSessions) PacketCountUnAck(id []byte) (uint64, error) {
+	return s.packetCount(id, bucketUnAck)
+}
+
+func (s *boltSessions) packetStore(id []byte, name []byte, packets []*vlpersistence.PersistedPacket) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		ses := session(tx, id)
+		if ses == nil {
+			return vlpersistence.ErrNotFound
+		}
+		for _, pkt := range packets {
+			err := putPacket(ses.Bucket(name), pkt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltSessions) PacketStoreQoS0(id []byte, pkt *vlpersistence.PersistedPacket) error {
+	return s.packetStore(id, bucketQoS0, []*vlpersistence.PersistedPacket{pkt})
+}
+
+func (s *boltSessions) PacketStoreQoS12(id []byte, pkt *vlpersistence.PersistedPacket) error {
+	return s.packetStore(id, bucketQoS12, []*vlpersistence.PersistedPacket{pkt})
+}
+
+func (s *boltSessions) PacketsStore(id []byte, packets vlpersistence.PersistedPackets) error {
+	err := s.packetStore(id, bucketQoS0, packets.QoS0)
+	if err != nil {
+		return err
+	}
+	err = s.packetStore(id, bucketQoS12, packets.QoS12)
+	if err != nil {
+		return err
+	}
+	return s.packetStore(id, bucketUnAck, packets.UnAck)
+}
+
+func (s *boltSessions) PacketsDelete(id []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		ses := session(tx, id)
+		if ses == nil {
+			return vlpersistence.ErrNotFound
+		}
+		for _, name := range [][]byte{bucketQoS0, bucketQoS12, bucketUnAck} {
+			err := ses.DeleteBucket(name)
+			if err != nil {
+				return err
+			}
+			_, err = ses.CreateBucket(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// packetsForEach calls load for the stored packets in the order they were
+// stored and deletes the packets load asks to remove
+func (s *boltSessions) packetsForEach(id []byte, name []byte, ctx interface{}, load vlpersistence.PacketLoader) error {
+	type entry struct {
+		key []byte
+		pkt *vlpersistence.PersistedPacket
+	}
+	var entries []entry
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ses := session(tx, id)
+		if ses == nil {
+			return nil
+		}
+		return ses.Bucket(name).ForEach(func(k, v []byte) error {
+			pkt := &vlpersistence.PersistedPacket{}
+			err := json.Unmarshal(v, pkt)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry{key: append([]byte(nil), k...), pkt: pkt})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	var remove [][]byte
+	for _, e := range entries {
+		rm, err := load(ctx, e.pkt)
+		if rm {
+			remove = append(remove, e.key)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(remove) == 0 {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		ses := session(tx, id)
+		if ses == nil {
+			return nil
+		}
+		for _, k := range remove {
+			err := ses.Bucket(name).Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltSessions) PacketsForEachQoS0(id []byte, ctx interface{}, load vlpersistence.PacketLoader) error {
+	return s.packetsForEach(id, bucketQoS0, ctx, load)
+}
+
+func (s *boltSessions) PacketsForEachQoS12(id []byte, ctx interface{}, load vlpersistence.PacketLoader) error {
+	return s.packetsForEach(id, bucketQoS12, ctx, load)
+}
+
+func (s *boltSessions) PacketsForEachUnAck(id []byte, ctx interface{}, load vlpersistence.PacketLoader) error {
+	return s.packetsForEach(id, bucketUnAck, ctx, load)
+}
+
+func getState(ses *bolt.Bucket) (*persistedState, error) {
+	st := &persistedState{}
+	data := ses.Get(keyState)
+	if data == nil {
+		return st, nil
+	}
+	err := json.Unmarshal(data, st)
+	return st, err
+}
+
+func putState(ses *bolt.Bucket, st *persistedState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return ses.Put(keyState, data)
+}
+
+// putRetained stores the retained message with the topic as key
+func putRetained(bucket *bolt.Bucket, topic string, pkt *vlpersistence.PersistedPacket) error {
+	data, err := json.Marshal(pkt)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(topic), data)
+}
+
+// putPacket stores the packet with the next sequence number as key
+func putPacket(bucket *bolt.Bucket, pkt *vlpersistence.PersistedPacket) error {
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+
+	data, err := json.Marshal(pkt)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
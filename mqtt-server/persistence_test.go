@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/VolantMQ/vlapi/mqttp"
+	"github.com/VolantMQ/vlapi/vlpersistence"
+)
+
+func tempDataDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mqtt-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func openTestPersistence(t *testing.T, dir string) *boltPersistence {
+	p, err := OpenBoltPersistence(dir)
+	if err != nil {
+		t.Fatalf("OpenBoltPersistence: %v", err)
+	}
+	return p
+}
+
+// encodePublish encodes a retained publish packet of the MQTT version
+func encodePublish(t *testing.T, version mqttp.ProtocolVersion, topic string, payload string) []byte {
+	pkt := mqttp.NewPublish(version)
+	err := pkt.Set(topic, []byte(payload), mqttp.QoS1, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt.SetPacketID(1)
+	data, err := mqttp.Encode(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// loadRetained returns the payloads of the retained messages by topic, the
+// messages must decode as MQTT 5 like VolantMQ decodes them
+func loadRetained(t *testing.T, p *boltPersistence) map[string]string {
+	retained, _ := p.Retained()
+	packets, err := retained.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	messages := make(map[string]string)
+	for _, pkt := range packets {
+		decoded, _, err := mqttp.Decode(mqttp.ProtocolV50, pkt.Data)
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		publish := decoded.(*mqttp.Publish)
+		messages[publish.Topic()] = string(publish.Payload())
+	}
+	return messages
+}
+
+type retainedWrite struct {
+	topic   string
+	qos     byte
+	payload string
+}
+
+func TestWriteRetained(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []retainedWrite
+		want   map[string]string
+	}{
+		{
+			name:   "store",
+			writes: []retainedWrite{{"/devices/d1/state", 1, "on"}, {"/devices/d2/state", 2, "off"}},
+			want:   map[string]string{"/devices/d1/state": "on", "/devices/d2/state": "off"},
+		},
+		{
+			name:   "replace",
+			writes: []retainedWrite{{"/devices/d1/state", 1, "on"}, {"/devices/d1/state", 1, "off"}},
+			want:   map[string]string{"/devices/d1/state": "off"},
+		},
+		{
+			name:   "clear",
+			writes: []retainedWrite{{"/devices/d1/state", 1, "on"}, {"/devices/d1/state", 1, ""}},
+			want:   map[string]string{},
+		},
+		{
+			name:   "qos 0 is not kept",
+			writes: []retainedWrite{{"/devices/d1/state", 1, "on"}, {"/devices/d1/state", 0, "off"}},
+			want:   map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := tempDataDir(t)
+			p := openTestPersistence(t, dir)
+			for _, w := range test.writes {
+				err := p.WriteRetained(w.topic, w.qos, []byte(w.payload))
+				if err != nil {
+					t.Fatalf("WriteRetained: %v", err)
+				}
+			}
+			// the messages are kept without a clean shutdown
+			p.db.Close()
+
+			p = openTestPersistence(t, dir)
+			defer p.Shutdown()
+			got := loadRetained(t, p)
+			if len(got) != len(test.want) {
+				t.Fatalf("retained = %v, want %v", got, test.want)
+			}
+			for topic, payload := range test.want {
+				if got[topic] != payload {
+					t.Errorf("retained %s = %q, want %q", topic, got[topic], payload)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreRetained(t *testing.T) {
+	dir := tempDataDir(t)
+	p := openTestPersistence(t, dir)
+	defer p.Shutdown()
+	err := p.WriteRetained("/devices/d0/state", 1, []byte("gone"))
+	if err != nil {
+		t.Fatalf("WriteRetained: %v", err)
+	}
+
+	// Store replaces the messages, both MQTT versions are stored as MQTT 5
+	retained, _ := p.Retained()
+	err = retained.Store([]*vlpersistence.PersistedPacket{
+		{Data: encodePublish(t, mqttp.ProtocolV311, "/devices/d1/state", "v3")},
+		{Data: encodePublish(t, mqttp.ProtocolV50, "/devices/d2/state", "v5")},
+		{Data: []byte("garbage")},
+	})
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	got := loadRetained(t, p)
+	if len(got) != 2 || got["/devices/d1/state"] != "v3" || got["/devices/d2/state"] != "v5" {
+		t.Errorf("retained = %v, want d1 v3 and d2 v5", got)
+	}
+
+	err = retained.Wipe()
+	if err != nil {
+		t.Fatalf("Wipe: %v", err)
+	}
+	if got := loadRetained(t, p); len(got) != 0 {
+		t.Errorf("retained = %v after wipe", got)
+	}
+}
+
+// sessionLoader collects the loaded sessions
+type sessionLoader map[string]*vlpersistence.SessionState
+
+func (l sessionLoader) LoadSession(ctx interface{}, id []byte, state *vlpersistence.SessionState) error {
+	l[string(id)] = state
+	return nil
+}
+
+func TestSessions(t *testing.T) {
+	dir := tempDataDir(t)
+	p := openTestPersistence(t, dir)
+	sessions, _ := p.Sessions()
+	id := []byte("client-1")
+
+	if sessions.Exists(id) {
+		t.Fatal("session exists before create")
+	}
+	err := sessions.Create(id, &vlpersistence.SessionBase{Timestamp: "t1", Version: 4})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := sessions.Create(id, &vlpersistence.SessionBase{}); err != vlpersistence.ErrAlreadyExists {
+		t.Errorf("second Create = %v, want %v", err, vlpersistence.ErrAlreadyExists)
+	}
+	err = sessions.SubscriptionsStore(id, []byte("subscriptions"))
+	if err != nil {
+		t.Fatalf("SubscriptionsStore: %v", err)
+	}
+	// the subscriptions of unknown sessions create the session
+	err = sessions.SubscriptionsStore([]byte("client-2"), []byte("other"))
+	if err != nil {
+		t.Fatalf("SubscriptionsStore of new session: %v", err)
+	}
+	if count := sessions.Count(); count != 2 {
+		t.Errorf("Count = %d, want 2", count)
+	}
+	err = sessions.ExpiryStore(id, &vlpersistence.SessionDelays{Since: "t2", ExpireIn: "10"})
+	if err != nil {
+		t.Fatalf("ExpiryStore: %v", err)
+	}
+	p.Shutdown()
+
+	p = openTestPersistence(t, dir)
+	defer p.Shutdown()
+	sessions, _ = p.Sessions()
+	loaded := sessionLoader{}
+	err = sessions.LoadForEach(loaded, nil)
+	if err != nil {
+		t.Fatalf("LoadForEach: %v", err)
+	}
+	state := loaded["client-1"]
+	if len(loaded) != 2 || state == nil {
+		t.Fatalf("loaded %d sessions, want client-1 and client-2", len(loaded))
+	}
+	if string(state.Subscriptions) != "subscriptions" || state.Timestamp != "t1" || state.Version != 4 ||
+		state.Expire == nil || state.Expire.ExpireIn != "10" {
+		t.Errorf("state = %+v", state)
+	}
+
+	err = sessions.Delete(id)
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := sessions.Delete(id); err != vlpersistence.ErrNotFound {
+		t.Errorf("second Delete = %v, want %v", err, vlpersistence.ErrNotFound)
+	}
+	if err := sessions.StateDelete(id); err != vlpersistence.ErrNotFound {
+		t.Errorf("StateDelete of deleted session = %v, want %v", err, vlpersistence.ErrNotFound)
+	}
+}
+
+func TestSessionPackets(t *testing.T) {
+	p := openTestPersistence(t, tempDataDir(t))
+	defer p.Shutdown()
+	sessions, _ := p.Sessions()
+	id := []byte("client-1")
+	err := sessions.Create(id, &vlpersistence.SessionBase{})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	err = sessions.PacketsStore(id, vlpersistence.PersistedPackets{
+		QoS0:  []*vlpersistence.PersistedPacket{{Data: []byte("0a")}},
+		QoS12: []*vlpersistence.PersistedPacket{{Data: []byte("1a")}, {Data: []byte("1b")}},
+		UnAck: []*vlpersistence.PersistedPacket{{Data: []byte("ua")}},
+	})
+	if err != nil {
+		t.Fatalf("PacketsStore: %v", err)
+	}
+	err = sessions.PacketStoreQoS12(id, &vlpersistence.PersistedPacket{Data: []byte("1c")})
+	if err != nil {
+		t.Fatalf("PacketStoreQoS12: %v", err)
+	}
+	if count, err := sessions.PacketCountQoS12(id); err != nil || count != 3 {
+		t.Errorf("PacketCountQoS12 = %d, %v, want 3", count, err)
+	}
+	if _, err := sessions.PacketCountQoS0([]byte("unknown")); err != vlpersistence.ErrNotFound {
+		t.Errorf("PacketCountQoS0 of unknown session = %v, want %v", err, vlpersistence.ErrNotFound)
+	}
+
+	// the packets are loaded in order and the ones asked are removed
+	var order []string
+	err = sessions.PacketsForEachQoS12(id, nil, func(_ interface{}, pkt *vlpersistence.PersistedPacket) (bool, error) {
+		order = append(order, string(pkt.Data))
+		return string(pkt.Data) != "1b", nil
+	})
+	if err != nil {
+		t.Fatalf("PacketsForEachQoS12: %v", err)
+	}
+	if !sort.StringsAreSorted(order) || len(order) != 3 {
+		t.Errorf("packets = %q, want 1a 1b 1c", order)
+	}
+	if count, _ := sessions.PacketCountQoS12(id); count != 1 {
+		t.Errorf("%d QoS 1/2 packets left, want 1", count)
+	}
+
+	err = sessions.PacketsDelete(id)
+	if err != nil {
+		t.Fatalf("PacketsDelete: %v", err)
+	}
+	for name, count := range map[string]func([]byte) (uint64, error){
+		"qos0":  sessions.PacketCountQoS0,
+		"qos12": sessions.PacketCountQoS12,
+		"unack": sessions.PacketCountUnAck,
+	} {
+		if n, _ := count(id); n != 0 {
+			t.Errorf("%d %s packets after delete", n, name)
+		}
+	}
+}
+
+func TestSystemInfo(t *testing.T) {
+	p := openTestPersistence(t, tempDataDir(t))
+	defer p.Shutdown()
+	system, _ := p.System()
+	info, err := system.GetInfo()
+	if err != nil || info.Version != "1" || info.CreatedAt == "" {
+		data, _ := json.Marshal(info)
+		t.Errorf("GetInfo = %s, %v", data, err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// replay republishes the audit log records of a time window into a broker.
+// The arguments are the flags followed by audit log files or directories.
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	broker := flags.String("broker", "tcp://127.0.0.1:8883", "MQTT broker address")
+	clientID := flags.String("client-id", "audit-replay", "MQTT client id, it must be allowed to publish to the replayed topics")
+	password := flags.String("password", os.Getenv("MQTT_PASSWORD"), "Token of the client id in the services file of the server")
+	from := flags.String("from", "", "Start of the replayed window in RFC3339, the first record if not set")
+	to := flags.String("to", "", "End of the replayed window in RFC3339, the last record if not set")
+	speed := flags.Float64("speed", 1, "Replay speed relative to the recorded timing, 0 publishes as fast as possible")
+	topics := flags.String("topics", "", "Comma separated topic filters of the replayed records, all if not set")
+	tlsCA := flags.String("tls-ca", "", "CA bundle used to verify an ssl:// broker, the system roots if not set")
+	tlsCert := flags.String("tls-cert", "", "Client certificate issued to the client id")
+	tlsKey := flags.String("tls-key", "", "Client private key")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [flags] <audit file or directory>...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no audit files given")
+	}
+	if *speed < 0 {
+		return errors.New("-speed must not be negative")
+	}
+	var start, end time.Time
+	var err error
+	if *from != "" {
+		start, err = time.Parse(time.RFC3339, *from)
+		if err != nil {
+			return fmt.Errorf("-from: %w", err)
+		}
+	}
+	if *to != "" {
+		end, err = time.Parse(time.RFC3339, *to)
+		if err != nil {
+			return fmt.Errorf("-to: %w", err)
+		}
+	}
+	var filters []string
+	if *topics != "" {
+		filters = strings.Split(*topics, ",")
+	}
+
+	files, err := auditFiles(flags.Args())
+	if err != nil {
+		return err
+	}
+	var records []auditRecord
+	for _, file := range files {
+		records, err = readAuditFile(file, records, func(r *auditRecord) bool {
+			if !start.IsZero() && r.Time.Before(start) {
+				return false
+			}
+			if !end.IsZero() && r.Time.After(end) {
+				return false
+			}
+			if filters == nil {
+				return true
+			}
+			for _, filter := range filters {
+				if topicFilterCovers(filter, r.Topic) {
+					return true
+				}
+			}
+			return false
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	if len(records) == 0 {
+		log.Printf("No records to replay")
+		return nil
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(*broker).
+		SetClientID(*clientID).
+		SetUsername(*clientID).
+		SetPassword(*password).
+		SetProtocolVersion(4) // Use MQTT 3.1.1
+	if strings.HasPrefix(*broker, "ssl://") || strings.HasPrefix(*broker, "tls://") {
+		tlsConfig, err := NewClientTLSConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			return err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	client := mqtt.NewClient(opts)
+	tok := client.Connect()
+	if !tok.WaitTimeout(5 * time.Second) {
+		return errors.New("MQTT connection timeout")
+	}
+	if err := tok.Error(); err != nil {
+		return fmt.Errorf("could not connect to MQTT broker: %w", err)
+	}
+	defer client.Disconnect(1000)
+
+	log.Printf("Replaying %d records from %v to %v", len(records), records[0].Time, records[len(records)-1].Time)
+	began := time.Now()
+	for _, r := range records {
+		if *speed > 0 {
+			offset := time.Duration(float64(r.Time.Sub(records[0].Time)) / *speed)
+			time.Sleep(time.Until(began.Add(offset)))
+		}
+		tok := client.Publish(r.Topic, r.QoS, r.Retain, r.Payload)
+		tok.Wait()
+		if err := tok.Error(); err != nil {
+			return fmt.Errorf("could not publish to %s: %w", r.Topic, err)
+		}
+		log.Printf("Replayed %s from %s recorded at %v", r.Topic, r.ClientID, r.Time)
+	}
+	return nil
+}
+
+// auditFiles expands the directories to the audit log files in them
+func auditFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "audit*.ndjson"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// readAuditFile appends the records of the file accepted by filter
+func readAuditFile(file string, records []auditRecord, filter func(*auditRecord) bool) ([]auditRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return records, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		var r auditRecord
+		err = json.Unmarshal(line, &r)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, n, err)
+		}
+		if filter(&r) {
+			records = append(records, r)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// errorTopic is the dead-letter topic of the device, the rejected publishes
+// are reported there
+const errorTopic = "/devices/%s/errors"
+
+// schemaRegistry has the JSON schemas of the device topics by topic suffix,
+// the part of the topic after /devices/<device-id>/. The schema of
+// /devices/<device-id>/events/flight-plan is read from
+// <dir>/events/flight-plan.json.
+type schemaRegistry struct {
+	schemas map[string]*gojsonschema.Schema
+}
+
+// LoadSchemas reads the *.json schema files from dir and its subdirectories
+func LoadSchemas(dir string) (*schemaRegistry, error) {
+	r := &schemaRegistry{schemas: make(map[string]*gojsonschema.Schema)}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(abs)))
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		r.schemas[filepath.ToSlash(strings.TrimSuffix(rel, ".json"))] = schema
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Len returns the number of loaded schemas
+func (r *schemaRegistry) Len() int {
+	return len(r.schemas)
+}
+
+// Validate checks the payload against the schema of the topic. The topics
+// without a schema are valid.
+func (r *schemaRegistry) Validate(topic string, payload []byte) []string {
+	deviceID, suffix, ok := splitDeviceTopic(topic)
+	if !ok || deviceID == "" {
+		return nil
+	}
+	schema, ok := r.schemas[suffix]
+	if !ok {
+		return nil
+	}
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(payload))
+	if err != nil {
+		return []string{fmt.Sprintf("invalid JSON: %v", err)}
+	}
+	var errs []string
+	for _, e := range result.Errors() {
+		errs = append(errs, e.String())
+	}
+	return errs
+}
+
+// splitDeviceTopic splits /devices/<device-id>/<suffix> topics
+func splitDeviceTopic(topic string) (deviceID string, suffix string, ok bool) {
+	parts := strings.SplitN(topic, "/", 4)
+	if len(parts) != 4 || parts[0] != "" || parts[1] != "devices" {
+		return "", "", false
+	}
+	return parts[2], parts[3], true
+}
+
+// deadLetter is the payload of the /devices/<device-id>/errors messages
+type deadLetter struct {
+	Topic     string    `json:"topic"`
+	ClientID  string    `json:"client_id"`
+	Errors    []string  `json:"errors"`
+	Payload   string    `json:"payload"`
+	Source    string    `json:"source"`
+	Timestamp time.Time `json:"timestamp"`
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	schemas, err := LoadSchemas("schemas")
+	if err != nil {
+		t.Fatalf("LoadSchemas: %v", err)
+	}
+	if schemas.Len() != 6 {
+		t.Errorf("%d schemas, want 6", schemas.Len())
+	}
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		// wantErr is part of the first error, valid if empty
+		wantErr string
+	}{
+		{"control", "/devices/d1/commands/control", `{"Command":"takeoff"}`, ""},
+		{"control without command", "/devices/d1/commands/control", `{"Payload":"x"}`, "Command is required"},
+		{"control empty command", "/devices/d1/commands/control", `{"Command":""}`, "Command"},
+		{"videostream command", "/devices/d1/commands/videostream", `{"Command":"pause"}`, "Command"},
+		{"flight plan", "/devices/d1/events/flight-plan", `[{"lat":1,"lon":2,"alt":3,"reached":true}]`, ""},
+		{"flight plan item", "/devices/d1/events/flight-plan", `[{"lat":1,"lon":2}]`, "alt is required"},
+		{"flight plan type", "/devices/d1/events/flight-plan", `{"lat":1}`, "Expected: array"},
+		{"not json", "/devices/d1/commands/control", `takeoff`, "invalid JSON"},
+		{"no schema", "/devices/d1/events/telemetry", `not json`, ""},
+		{"subfolder without schema", "/devices/d1/commands/control/extra", `x`, ""},
+		{"not a device topic", "/other/d1/commands/control", `x`, ""},
+		{"no device id", "/devices//commands/control", `x`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := schemas.Validate(test.topic, []byte(test.payload))
+			if test.wantErr == "" {
+				if len(errs) != 0 {
+					t.Errorf("Validate = %q, want valid", errs)
+				}
+				return
+			}
+			if len(errs) == 0 || !strings.Contains(errs[0], test.wantErr) {
+				t.Errorf("Validate = %q, want error '%s'", errs, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadSchemasInvalid(t *testing.T) {
+	dir := tempDataDir(t)
+	err := ioutil.WriteFile(filepath.Join(dir, "bad.json"), []byte(`{"type": 1}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSchemas(dir); err == nil || !strings.Contains(err.Error(), "bad.json") {
+		t.Errorf("LoadSchemas = %v, want error of bad.json", err)
+	}
+}
+
+func TestSplitDeviceTopic(t *testing.T) {
+	tests := []struct {
+		topic    string
+		deviceID string
+		suffix   string
+		ok       bool
+	}{
+		{"/devices/d1/events/telemetry", "d1", "events/telemetry", true},
+		{"/devices/d1/state", "d1", "state", true},
+		{"/devices/d1", "", "", false},
+		{"devices/d1/state", "", "", false},
+		{"/other/d1/state", "", "", false},
+	}
+	for _, test := range tests {
+		deviceID, suffix, ok := splitDeviceTopic(test.topic)
+		if deviceID != test.deviceID || suffix != test.suffix || ok != test.ok {
+			t.Errorf("splitDeviceTopic(%s) = %s, %s, %v", test.topic, deviceID, suffix, ok)
+		}
+	}
+}
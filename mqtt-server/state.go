@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// stateTopicFilter matches the connection state topics, only the server
+// publishes to them
+const stateTopicFilter = "/devices/+/state"
+
+const (
+	stateOnline  = "online"
+	stateOffline = "offline"
+)
+
+// connectionState is the payload of the retained /devices/<device-id>/state
+// messages
+type connectionState struct {
+	State     string    `json:"state"`
+	Timestamp time.Time `json:"timestamp"`
+	Reason    string    `json:"reason"`
+}
+
+type serverMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// serverPublisher publishes the messages of the server: the connection
+// state changes of the devices and the dead letters of the rejected
+// publishes. It connects to the broker listener directly, not through a
+// frontend, with the certAuth credentials.
+type serverPublisher struct {
+	client    mqtt.Client
+	connected mqtt.Token
+	queue     chan serverMessage
+	done      chan struct{}
+	// retained stores the published states, disabled if nil
+	retained retainedWriter
+
+	lock   sync.Mutex
+	closed bool
+}
+
+func NewServerPublisher(broker string, certToken string, retained retainedWriter) *serverPublisher {
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID("mqtt-server").
+		SetUsername(certUser).
+		SetPassword(certToken).
+		SetProtocolVersion(4). // Use MQTT 3.1.1
+		SetConnectRetry(true).
+		SetConnectRetryInterval(time.Second).
+		SetAutoReconnect(true)
+	p := &serverPublisher{
+		client:   mqtt.NewClient(opts),
+		retained: retained,
+		queue:    make(chan serverMessage, 1000),
+		done:     make(chan struct{}),
+	}
+	p.connected = p.client.Connect()
+	go p.run()
+	return p
+}
+
+// PublishState queues the retained state message of the device
+func (p *serverPublisher) PublishState(deviceID string, state string, reason string) {
+	payload, err := json.Marshal(connectionState{
+		State:     state,
+		Timestamp: time.Now().UTC(),
+		Reason:    reason,
+	})
+	if err != nil {
+		log.Printf("Could not marshal state of device %s: %v", deviceID, err)
+		return
+	}
+	p.publish(serverMessage{
+		topic:   "/devices/" + deviceID + "/state",
+		payload: payload,
+		retain:  true,
+	})
+}
+
+// PublishError queues the dead letter of a rejected publish of the device
+func (p *serverPublisher) PublishError(deviceID string, letter deadLetter) {
+	payload, err := json.Marshal(letter)
+	if err != nil {
+		log.Printf("Could not marshal dead letter of device %s: %v", deviceID, err)
+		return
+	}
+	p.publish(serverMessage{
+		topic:   fmt.Sprintf(errorTopic, deviceID),
+		payload: payload,
+	})
+}
+
+func (p *serverPublisher) publish(msg serverMessage) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return
+	}
+	select {
+	case p.queue <- msg:
+	default:
+		log.Printf("Server message queue is full, dropping message to %s", msg.topic)
+	}
+}
+
+func (p *serverPublisher) run() {
+	defer close(p.done)
+
+	// paho drops the publishes stored while connecting with a clean session
+	p.connected.Wait()
+	for msg := range p.queue {
+		tok := p.client.Publish(msg.topic, 1, msg.retain, msg.payload)
+		tok.Wait()
+		if err := tok.Error(); err != nil {
+			log.Printf("Could not publish to %s: %v", msg.topic, err)
+			continue
+		}
+		if msg.retain && p.retained != nil {
+			err := p.retained.WriteRetained(msg.topic, 1, msg.payload)
+			if err != nil {
+				log.Printf("Could not persist retained message of %s: %v", msg.topic, err)
+			}
+		}
+	}
+}
+
+// Close publishes the queued messages and disconnects from the broker
+func (p *serverPublisher) Close(timeout time.Duration) {
+	p.lock.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.lock.Unlock()
+
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		log.Printf("Timed out publishing server messages")
+	}
+	p.client.Disconnect(250)
+}
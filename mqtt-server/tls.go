@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// NewTLSConfig creates the server TLS config. clientAuth is one of
+// "none", "request" or "require". If clientCAFile is set, the presented
+// client certificates must be issued by one of the CAs.
+func NewTLSConfig(certFile, keyFile, clientCAFile, clientAuth string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if clientCAFile != "" {
+		caData, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(caData) {
+			return nil, errors.New("no certificates found from client CA file")
+		}
+	}
+
+	switch clientAuth {
+	case "none":
+		tlsConfig.ClientAuth = tls.NoClientCert
+	case "request":
+		tlsConfig.ClientAuth = tls.RequestClientCert
+		if tlsConfig.ClientCAs != nil {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		if tlsConfig.ClientCAs != nil {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	default:
+		return nil, fmt.Errorf("unknown client auth mode %q", clientAuth)
+	}
+
+	return tlsConfig, nil
+}
+
+// NewClientTLSConfig creates the TLS config of a connection to another
+// broker. caFile is used to verify the broker, the system roots if empty.
+// certFile and keyFile are the optional client certificate.
+func NewClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		caData, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, errors.New("no certificates found from CA file")
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
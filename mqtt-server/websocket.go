@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+
+	"nhooyr.io/websocket"
+)
+
+// ServeWebSocket accepts MQTT over WebSocket connections on /mqtt. The
+// connections are handled like the TCP connections of the frontend.
+func (f *frontend) ServeWebSocket(originPatterns []string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mqtt", func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols:   []string{"mqtt"},
+			OriginPatterns: originPatterns,
+		})
+		if err != nil {
+			log.Printf("Frontend: websocket accept from %v: %v", r.RemoteAddr, err)
+			return
+		}
+		if c.Subprotocol() != "mqtt" {
+			c.Close(websocket.StatusPolicyViolation, "mqtt subprotocol required")
+			return
+		}
+
+		conn := &wsConn{
+			Conn:       websocket.NetConn(context.Background(), c, websocket.MessageBinary),
+			remoteAddr: remoteAddr(r.RemoteAddr),
+		}
+		if !f.track(conn) {
+			c.Close(websocket.StatusTryAgainLater, "too many connections")
+			return
+		}
+		f.serveConn(conn)
+	})
+
+	return f.stop(http.Serve(f.listener, mux))
+}
+
+// wsConn reports the remote address of the HTTP request, websocket.NetConn
+// does not know it
+type wsConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func remoteAddr(addr string) net.Addr {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return tcpAddr
+}
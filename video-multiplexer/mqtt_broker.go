@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -12,10 +13,17 @@ func newMQTTClient(id string, brokerAddress string) mqtt.Client {
 		AddBroker(brokerAddress).
 		SetClientID(id).
 		SetUsername(id).
-		//SetTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}).
-		SetPassword("").
+		SetPassword(os.Getenv("MQTT_PASSWORD")).
 		SetProtocolVersion(4) // Use MQTT 3.1.1
 
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		log.Fatalf("Could not create MQTT TLS config: %v", err)
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
 	client := mqtt.NewClient(opts)
 
 	tok := client.Connect()
@@ -25,7 +33,7 @@ func newMQTTClient(id string, brokerAddress string) mqtt.Client {
 	if !tok.WaitTimeout(time.Second * 5) {
 		log.Fatal("MQTT connection timeout")
 	}
-	err := tok.Error()
+	err = tok.Error()
 	if err != nil {
 		log.Fatalf("Could not connect to MQTT broker: %v", err)
 	}
@@ -0,0 +1,47 @@
+package main
+
+// mqtt_tls.go is the same file in mission-control, video-multiplexer and
+// video-test-server, which are built as separate modules. Change
+// mission-control/mqtt_tls.go and copy it to the others, the mqtt-tls
+// workflow fails if the copies differ.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// newTLSConfig reads the TLS options of the MQTT connection from environment.
+// MQTT_TLS_CA is the CA bundle used to verify the broker and MQTT_TLS_CERT and
+// MQTT_TLS_KEY are the client certificate and key. Returns nil if none are set.
+func newTLSConfig() (*tls.Config, error) {
+	caFile := os.Getenv("MQTT_TLS_CA")
+	certFile := os.Getenv("MQTT_TLS_CERT")
+	keyFile := os.Getenv("MQTT_TLS_KEY")
+	if caFile == "" && certFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		caData, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found from %s", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}